@@ -0,0 +1,160 @@
+package network
+
+import (
+	"gotor/internal/trackerproto"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// used when a tracker does not send an interval
+	defaultAnnounceInterval = 30 * time.Minute
+	// first wait after a failed announce, doubled on every further failure
+	announceRetryInterval = time.Minute
+	// how long Stop waits for Run to end and the stopped event to go out
+	stopAnnounceTimeout = 10 * time.Second
+)
+
+// AnnounceCounters reports the transfer totals sent with every announce
+type AnnounceCounters func() (uploaded, downloaded, left int64)
+
+// Announcer keeps a torrent announced to its trackers. It re-announces after
+// the interval the tracker asked for, sends completed once the download
+// finishes and stopped when it is stopped
+type Announcer struct {
+	trackers  *TrackerManager
+	params    AnnounceParams
+	counters  AnnounceCounters
+	onPeers   func([]Peer)
+	completed <-chan struct{}
+	done      chan struct{}
+	finished  chan struct{}
+	stopOnce  sync.Once
+}
+
+// NewAnnouncer creates an announcer. params carries the fields that don't
+// change between announces, the counters are read fresh every time. Peers
+// returned by the trackers are passed to onPeers. completed may be nil
+func NewAnnouncer(trackers *TrackerManager, params AnnounceParams, counters AnnounceCounters, completed <-chan struct{}, onPeers func([]Peer)) *Announcer {
+	return &Announcer{
+		trackers:  trackers,
+		params:    params,
+		counters:  counters,
+		onPeers:   onPeers,
+		completed: completed,
+		done:      make(chan struct{}),
+		finished:  make(chan struct{}),
+	}
+}
+
+// Run announces until Stop is called. last is the response to the started
+// event announced before the swarm was set up, nil if that announce failed
+// in which case started is sent again
+func (an *Announcer) Run(last *AnnounceResponse) {
+	defer close(an.finished)
+
+	event := trackerproto.EventNone
+	if last == nil {
+		event = trackerproto.EventStarted
+	}
+
+	retry := announceRetryInterval
+	wait := an.nextInterval(last, retry)
+	completed := an.completed
+
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-an.done:
+			timer.Stop()
+			return
+		case <-completed:
+			timer.Stop()
+			completed = nil
+			if event != trackerproto.EventStarted {
+				event = trackerproto.EventCompleted
+			}
+		case <-timer.C:
+		}
+
+		resp, err := an.announce(event)
+		if err != nil {
+			log.Printf("Announce failed: %v\n", err)
+			wait = retry
+			retry = min(retry*2, defaultAnnounceInterval)
+			continue
+		}
+
+		if an.onPeers != nil && len(resp.Peers) > 0 {
+			an.onPeers(resp.Peers)
+		}
+
+		if event == trackerproto.EventStarted && completed == nil && an.completed != nil {
+			// finished while the started event was still failing
+			event = trackerproto.EventCompleted
+			wait = 0
+			continue
+		}
+
+		event = trackerproto.EventNone
+		retry = announceRetryInterval
+		wait = an.nextInterval(resp, retry)
+	}
+}
+
+// Stop ends Run and tells the trackers we are leaving. It returns after
+// stopAnnounceTimeout at the latest
+func (an *Announcer) Stop() {
+	an.stopOnce.Do(func() {
+		close(an.done)
+
+		timeout := time.NewTimer(stopAnnounceTimeout)
+		defer timeout.Stop()
+
+		// Run may be stuck announcing to an unresponsive tracker
+		select {
+		case <-an.finished:
+		case <-timeout.C:
+			log.Println("Announcer did not stop in time, not announcing stopped")
+			return
+		}
+
+		sent := make(chan struct{})
+		go func() {
+			defer close(sent)
+			if _, err := an.announce(trackerproto.EventStopped); err != nil {
+				log.Printf("Announcing stopped failed: %v\n", err)
+			}
+		}()
+
+		select {
+		case <-sent:
+		case <-timeout.C:
+			log.Println("Announcing stopped timed out")
+		}
+	})
+}
+
+func (an *Announcer) announce(event trackerproto.Event) (*AnnounceResponse, error) {
+	params := an.params
+	params.Uploaded, params.Downloaded, params.Left = an.counters()
+	params.Event = event
+
+	return an.trackers.Announce(params)
+}
+
+// nextInterval honours the interval of the tracker but never goes below its
+// min interval
+func (an *Announcer) nextInterval(resp *AnnounceResponse, retry time.Duration) time.Duration {
+	if resp == nil {
+		return retry
+	}
+
+	interval := resp.Interval
+	if interval <= 0 {
+		interval = defaultAnnounceInterval
+	}
+
+	return max(interval, resp.MinInterval)
+}
@@ -0,0 +1,143 @@
+package network
+
+import (
+	"log"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	rechokeInterval = 10 * time.Second
+	// the optimistic unchoke rotates every third rechoke, i.e. every 30s
+	optimisticRounds   = 3
+	DefaultUploadSlots = 4
+)
+
+// Choker runs the tit-for-tat rechoke loop of a swarm. While downloading it
+// unchokes the peers that upload fastest to us, while seeding the ones that
+// download fastest from us. One rotating optimistic unchoke is added to
+// the upload slots. While downloading, peers snubbing us only get the
+// optimistic unchoke
+type Choker struct {
+	swarm       *Swarm
+	uploadSlots int
+	optimistic  *PeerConnection
+	round       int
+	lastBytes   map[*PeerConnection]uint64
+}
+
+func NewChoker(swarm *Swarm, uploadSlots int) *Choker {
+	if uploadSlots < 1 {
+		uploadSlots = DefaultUploadSlots
+	}
+
+	return &Choker{
+		swarm:       swarm,
+		uploadSlots: uploadSlots,
+		lastBytes:   make(map[*PeerConnection]uint64),
+	}
+}
+
+// Run rechokes every 10 seconds until the swarm is closed
+func (c *Choker) Run() {
+	ticker := time.NewTicker(rechokeInterval)
+	defer ticker.Stop()
+
+	for {
+		c.rechoke()
+
+		select {
+		case <-c.swarm.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type chokeCandidate struct {
+	pc      *PeerConnection
+	rate    uint64
+	snubbed bool
+}
+
+func (c *Choker) rechoke() {
+	peers := c.swarm.Peers()
+	seeding := c.swarm.pieceManager.Progress() >= 1
+
+	// bytes moved since the previous round, the interval is fixed so the
+	// delta is as good as a rate for ranking
+	bytes := make(map[*PeerConnection]uint64, len(peers))
+	var interested []chokeCandidate
+	for _, pc := range peers {
+		total := pc.downloaded.Load()
+		if seeding {
+			total = pc.uploaded.Load()
+		}
+		bytes[pc] = total
+
+		if pc.isPeerInterested() {
+			interested = append(interested, chokeCandidate{pc: pc, rate: total - c.lastBytes[pc], snubbed: !seeding && pc.snubbed.Load()})
+		}
+	}
+	c.lastBytes = bytes
+
+	if c.round%optimisticRounds == 0 || !c.isConnected(c.optimistic, peers) || !c.optimistic.isPeerInterested() {
+		c.optimistic = c.pickOptimistic(interested)
+	}
+	c.round++
+
+	sort.Slice(interested, func(i, j int) bool {
+		return interested[i].rate > interested[j].rate
+	})
+
+	// the optimistic unchoke comes on top of the upload slots
+	unchoke := make(map[*PeerConnection]bool, c.uploadSlots+1)
+	for _, candidate := range interested {
+		if len(unchoke) >= c.uploadSlots {
+			break
+		}
+		if candidate.pc != c.optimistic && !candidate.snubbed {
+			unchoke[candidate.pc] = true
+		}
+	}
+	if c.optimistic != nil {
+		unchoke[c.optimistic] = true
+	}
+
+	for _, pc := range peers {
+		if err := pc.setChoking(!unchoke[pc]); err != nil {
+			log.Printf("Peer %s: %v\n", pc.peer.String(), err)
+		}
+	}
+}
+
+// pickOptimistic chooses a random interested peer that we currently choke
+func (c *Choker) pickOptimistic(interested []chokeCandidate) *PeerConnection {
+	var choked []*PeerConnection
+	for _, candidate := range interested {
+		if candidate.pc.isChoking() {
+			choked = append(choked, candidate.pc)
+		}
+	}
+
+	if len(choked) == 0 {
+		return nil
+	}
+
+	return choked[rand.Intn(len(choked))]
+}
+
+func (c *Choker) isConnected(pc *PeerConnection, peers []*PeerConnection) bool {
+	if pc == nil {
+		return false
+	}
+
+	for _, p := range peers {
+		if p == pc {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,202 @@
+package network
+
+import (
+	"fmt"
+	"gotor/internal/storage"
+	"gotor/internal/testutil"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func newChokerTestSwarm(t *testing.T) *Swarm {
+	t.Helper()
+
+	ti := testutil.NewTorrentInfo(t, 40000, 16384, false)
+	s := NewSwarm(ti, "peer", nil, storage.NewPieceManager(ti), nil, 0, NewConnLimiter(DefaultConnLimits()))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// addChokerTestPeer adds an established connection to s whose messages are
+// discarded
+func addChokerTestPeer(t *testing.T, s *Swarm, interested bool) *PeerConnection {
+	t.Helper()
+
+	s.Lock()
+	addr := netip.MustParseAddrPort(fmt.Sprintf("192.0.2.%d:6881", len(s.conns)+1))
+	s.Unlock()
+
+	pc := NewPeerConnection(NewPeer(addr), s.torrentInfo, "peer", nil, s.pieceManager, nil)
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	go io.Copy(io.Discard, remote)
+	pc.conn = local
+	pc.swarm = s
+	pc.peerInterested = interested
+	pc.established.Store(true)
+
+	s.Lock()
+	s.conns[pc] = struct{}{}
+	s.Unlock()
+
+	return pc
+}
+
+func unchoked(peers []*PeerConnection) []*PeerConnection {
+	var open []*PeerConnection
+	for _, pc := range peers {
+		if !pc.isChoking() {
+			open = append(open, pc)
+		}
+	}
+	return open
+}
+
+func TestRechokeUnchokesFastestPeers(t *testing.T) {
+	s := newChokerTestSwarm(t)
+	c := NewChoker(s, 2)
+
+	var peers []*PeerConnection
+	for range 5 {
+		peers = append(peers, addChokerTestPeer(t, s, true))
+	}
+	idle := addChokerTestPeer(t, s, false)
+	idle.downloaded.Store(1 << 20)
+
+	for i, pc := range peers {
+		pc.downloaded.Store(uint64(i+1) * 1000)
+	}
+	// the optimistic unchoke goes to a slow peer, the two fastest keep the
+	// upload slots
+	c.optimistic = peers[0]
+	c.round = 1
+	c.rechoke()
+
+	open := unchoked(s.Peers())
+	if len(open) != 3 {
+		t.Fatalf("%d peers unchoked, want 2 slots and the optimistic unchoke", len(open))
+	}
+	for _, pc := range []*PeerConnection{peers[4], peers[3], peers[0]} {
+		if pc.isChoking() {
+			t.Errorf("peer %s is choked", pc.peer.String())
+		}
+	}
+	if !idle.isChoking() {
+		t.Error("unchoked a peer that is not interested")
+	}
+}
+
+func TestRechokeRanksByRecentRate(t *testing.T) {
+	s := newChokerTestSwarm(t)
+	c := NewChoker(s, 1)
+
+	early := addChokerTestPeer(t, s, true)
+	late := addChokerTestPeer(t, s, true)
+	other := addChokerTestPeer(t, s, true)
+	c.optimistic = other
+	c.round = 1
+
+	early.downloaded.Store(10000)
+	c.rechoke()
+	if early.isChoking() {
+		t.Fatal("choked the fastest peer")
+	}
+
+	// early sent a lot in the first round only, late is faster now
+	late.downloaded.Store(5000)
+	c.rechoke()
+	if !early.isChoking() {
+		t.Error("kept the slot for a peer that stopped sending")
+	}
+	if late.isChoking() {
+		t.Error("choked the fastest peer of the last round")
+	}
+}
+
+func TestOptimisticUnchokeRotates(t *testing.T) {
+	s := newChokerTestSwarm(t)
+	c := NewChoker(s, 1)
+
+	var peers []*PeerConnection
+	for range 4 {
+		peers = append(peers, addChokerTestPeer(t, s, true))
+	}
+
+	c.rechoke()
+	first := c.optimistic
+	if first == nil {
+		t.Fatal("no optimistic unchoke")
+	}
+
+	for round := 1; round < optimisticRounds; round++ {
+		c.rechoke()
+		if c.optimistic != first {
+			t.Fatalf("optimistic unchoke changed after %d rounds", round)
+		}
+		if got := len(unchoked(peers)); got != 2 {
+			t.Fatalf("%d peers unchoked, want 2", got)
+		}
+	}
+
+	// the next pick is among the choked peers, so it cannot be the same one
+	c.rechoke()
+	if c.optimistic == nil || c.optimistic == first {
+		t.Error("optimistic unchoke did not rotate")
+	}
+	if c.optimistic.isChoking() {
+		t.Error("optimistic peer is choked")
+	}
+}
+
+func TestOptimisticUnchokeReplacedWhenUninterested(t *testing.T) {
+	s := newChokerTestSwarm(t)
+	c := NewChoker(s, 1)
+
+	for range 3 {
+		addChokerTestPeer(t, s, true)
+	}
+
+	c.rechoke()
+	first := c.optimistic
+	first.uploadMu.Lock()
+	first.peerInterested = false
+	first.uploadMu.Unlock()
+
+	c.rechoke()
+	if c.optimistic == first {
+		t.Error("kept an uninterested optimistic unchoke")
+	}
+	if !first.isChoking() {
+		t.Error("uninterested peer stays unchoked")
+	}
+}
+
+func TestRechokeSkipsSnubbingPeers(t *testing.T) {
+	s := newChokerTestSwarm(t)
+	c := NewChoker(s, 1)
+
+	snubbing := addChokerTestPeer(t, s, true)
+	slow := addChokerTestPeer(t, s, true)
+	other := addChokerTestPeer(t, s, true)
+	c.optimistic = other
+	c.round = 1
+
+	// it sent a lot earlier but leaves our requests unanswered now
+	snubbing.downloaded.Store(10000)
+	snubbing.snubbed.Store(true)
+	slow.downloaded.Store(100)
+	c.rechoke()
+
+	if !snubbing.isChoking() {
+		t.Error("gave an upload slot to a peer snubbing us")
+	}
+	if slow.isChoking() {
+		t.Error("choked the fastest peer that is not snubbing us")
+	}
+}
@@ -0,0 +1,395 @@
+package network
+
+import (
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// the address book of a torrent stops growing here
+	maxKnownPeers = 2000
+	// failed peers are retried after connRetryBase, doubling up to connRetryMax
+	connRetryBase = 30 * time.Second
+	connRetryMax  = 30 * time.Minute
+	// peers failing this many times in a row are forgotten
+	maxConnFailures = 6
+	// dropped useless peers are left alone for this long
+	connUselessBackoff = time.Hour
+	// connected peers that exchanged no data for this long make room for
+	// others when the torrent is at its limit
+	connIdleLimit     = 5 * time.Minute
+	connManagerTick   = 5 * time.Second
+	connPruneInterval = time.Minute
+)
+
+// ConnLimits caps peer connections, globally and for each torrent. Half-open
+// connections are dials that did not finish their handshake yet
+type ConnLimits struct {
+	MaxConns              int
+	MaxHalfOpen           int
+	MaxConnsPerTorrent    int
+	MaxHalfOpenPerTorrent int
+}
+
+func DefaultConnLimits() ConnLimits {
+	return ConnLimits{
+		MaxConns:              200,
+		MaxHalfOpen:           20,
+		MaxConnsPerTorrent:    50,
+		MaxHalfOpenPerTorrent: 8,
+	}
+}
+
+// ConnLimiter is shared by every swarm and counts their connections against
+// the global limits
+type ConnLimiter struct {
+	sync.Mutex
+	limits   ConnLimits
+	conns    int
+	halfOpen int
+}
+
+func NewConnLimiter(limits ConnLimits) *ConnLimiter {
+	return &ConnLimiter{limits: limits}
+}
+
+func (l *ConnLimiter) Limits() ConnLimits {
+	return l.limits
+}
+
+// Stats returns the open and half-open connections of all torrents
+func (l *ConnLimiter) Stats() (conns int, halfOpen int) {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.conns, l.halfOpen
+}
+
+func (l *ConnLimiter) reserve(halfOpen bool) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.conns+l.halfOpen >= l.limits.MaxConns {
+		return false
+	}
+
+	if halfOpen {
+		if l.halfOpen >= l.limits.MaxHalfOpen {
+			return false
+		}
+		l.halfOpen++
+	} else {
+		l.conns++
+	}
+
+	return true
+}
+
+func (l *ConnLimiter) opened() {
+	l.Lock()
+	defer l.Unlock()
+
+	l.halfOpen--
+	l.conns++
+}
+
+func (l *ConnLimiter) release(halfOpen bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	if halfOpen {
+		l.halfOpen--
+	} else {
+		l.conns--
+	}
+}
+
+// ConnStats are the connection counts of one torrent
+type ConnStats struct {
+	Connected int
+	HalfOpen  int
+	Known     int
+}
+
+type peerEntry struct {
+	failures    int
+	nextAttempt time.Time
+	dialing     bool
+	connected   bool
+	useless     bool
+}
+
+// connManager owns the address book of a swarm and decides which peers to
+// dial, keeping within the limits and backing off from failing peers
+type connManager struct {
+	sync.Mutex
+	swarm    *Swarm
+	limiter  *ConnLimiter
+	book     map[Peer]*peerEntry
+	conns    int
+	halfOpen int
+	// payload totals of the connected peers at the time they last changed
+	activity map[*PeerConnection]peerActivity
+	wake     chan struct{}
+}
+
+type peerActivity struct {
+	bytes uint64
+	since time.Time
+}
+
+func newConnManager(swarm *Swarm, limiter *ConnLimiter) *connManager {
+	return &connManager{
+		swarm:    swarm,
+		limiter:  limiter,
+		book:     make(map[Peer]*peerEntry),
+		activity: make(map[*PeerConnection]peerActivity),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+func (m *connManager) add(peers []Peer) {
+	m.Lock()
+	added := false
+	for _, peer := range peers {
+		if _, ok := m.book[peer]; ok {
+			continue
+		}
+		if len(m.book) >= maxKnownPeers {
+			break
+		}
+
+		m.book[peer] = &peerEntry{}
+		added = true
+	}
+	m.Unlock()
+
+	if added {
+		m.signal()
+	}
+}
+
+func (m *connManager) signal() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *connManager) stats() ConnStats {
+	m.Lock()
+	defer m.Unlock()
+
+	return ConnStats{Connected: m.conns, HalfOpen: m.halfOpen, Known: len(m.book)}
+}
+
+// candidates returns the peers due for a dial, those that failed least often
+// first
+func (m *connManager) candidates() []Peer {
+	now := time.Now()
+
+	var peers []Peer
+	for peer, entry := range m.book {
+		if !entry.dialing && !entry.connected && !entry.nextAttempt.After(now) {
+			peers = append(peers, peer)
+		}
+	}
+
+	slices.SortStableFunc(peers, func(a, b Peer) int {
+		return m.book[a].failures - m.book[b].failures
+	})
+
+	return peers
+}
+
+// fill dials candidates until a limit is reached
+func (m *connManager) fill() {
+	m.Lock()
+	defer m.Unlock()
+
+	limits := m.limiter.Limits()
+	for _, peer := range m.candidates() {
+		if m.conns+m.halfOpen >= limits.MaxConnsPerTorrent || m.halfOpen >= limits.MaxHalfOpenPerTorrent {
+			return
+		}
+		if !m.limiter.reserve(true) {
+			return
+		}
+
+		m.book[peer].dialing = true
+		m.halfOpen++
+		go m.dial(peer)
+	}
+}
+
+func (m *connManager) dial(peer Peer) {
+	s := m.swarm
+	pc := NewPeerConnection(peer, s.torrentInfo, s.myPeerId, s.fileManager, s.pieceManager, s.extensions)
+	pc.onEstablished = func() {
+		m.established(peer)
+	}
+
+	err := s.run(pc)
+	m.finished(peer, pc, err)
+}
+
+func (m *connManager) established(peer Peer) {
+	m.Lock()
+	defer m.Unlock()
+
+	entry := m.book[peer]
+	entry.dialing = false
+	entry.connected = true
+	m.halfOpen--
+	m.conns++
+	m.limiter.opened()
+}
+
+func (m *connManager) finished(peer Peer, pc *PeerConnection, err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	entry := m.book[peer]
+	if entry.connected {
+		m.conns--
+		m.limiter.release(false)
+	} else {
+		m.halfOpen--
+		m.limiter.release(true)
+	}
+	entry.dialing = false
+	entry.connected = false
+	delete(m.activity, pc)
+
+	switch {
+	case entry.useless:
+		entry.useless = false
+		entry.nextAttempt = time.Now().Add(connUselessBackoff)
+	case pc.downloaded.Load()+pc.uploaded.Load() > 0:
+		entry.failures = 0
+		entry.nextAttempt = time.Now().Add(connRetryBase)
+	default:
+		entry.failures++
+		if entry.failures >= maxConnFailures {
+			log.Printf("Peer %s: %v, giving up\n", peer.String(), err)
+			delete(m.book, peer)
+			break
+		}
+
+		delay := connRetryDelay(entry.failures)
+		entry.nextAttempt = time.Now().Add(delay)
+		log.Printf("Peer %s: %v, retrying in %s\n", peer.String(), err, delay)
+	}
+
+	m.signal()
+}
+
+// connRetryDelay is how long a peer is left alone after failing this many
+// times in a row
+func connRetryDelay(failures int) time.Duration {
+	delay := connRetryBase
+	for range failures - 1 {
+		if delay >= connRetryMax {
+			break
+		}
+		delay *= 2
+	}
+
+	return min(delay, connRetryMax)
+}
+
+// acceptIncoming takes a connection slot for a peer that connected to us
+func (m *connManager) acceptIncoming() bool {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.conns+m.halfOpen >= m.limiter.Limits().MaxConnsPerTorrent {
+		return false
+	}
+	if !m.limiter.reserve(false) {
+		return false
+	}
+
+	m.conns++
+	return true
+}
+
+func (m *connManager) closeIncoming(pc *PeerConnection) {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.activity, pc)
+	m.conns--
+	m.limiter.release(false)
+}
+
+// prune drops connections that are no use to either side. Seeds are useless
+// once we are seeding ourselves, idle peers only when others are waiting for
+// their slot
+func (m *connManager) prune() {
+	seeding := false
+	select {
+	case <-m.swarm.pieceManager.Done():
+		seeding = true
+	default:
+	}
+
+	peers := m.swarm.Peers()
+
+	m.Lock()
+	full := m.conns+m.halfOpen >= m.limiter.Limits().MaxConnsPerTorrent
+	waiting := len(m.candidates()) > 0
+
+	var drop []*PeerConnection
+	now := time.Now()
+	for _, pc := range peers {
+		bytes := pc.downloaded.Load() + pc.uploaded.Load()
+		last, ok := m.activity[pc]
+		if !ok || last.bytes != bytes {
+			m.activity[pc] = peerActivity{bytes: bytes, since: now}
+		}
+
+		idle := ok && last.bytes == bytes && now.Sub(last.since) > connIdleLimit
+		if (seeding && pc.peerSeed.Load()) || (idle && full && waiting) {
+			if entry, ok := m.book[pc.peer]; ok {
+				entry.useless = true
+			}
+			drop = append(drop, pc)
+		}
+	}
+	m.Unlock()
+
+	for _, pc := range drop {
+		log.Printf("Peer %s: dropping useless peer\n", pc.peer.String())
+		pc.Stop()
+	}
+}
+
+// RunConnections dials peers from the address book until the swarm is closed
+func (s *Swarm) RunConnections() {
+	ticker := time.NewTicker(connManagerTick)
+	defer ticker.Stop()
+
+	pruneTicker := time.NewTicker(connPruneInterval)
+	defer pruneTicker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.manager.wake:
+		case <-ticker.C:
+		case <-pruneTicker.C:
+			s.manager.prune()
+		}
+
+		s.manager.fill()
+	}
+}
+
+// ConnStats returns the connection counts shown in the UI
+func (s *Swarm) ConnStats() ConnStats {
+	return s.manager.stats()
+}
@@ -0,0 +1,304 @@
+package network
+
+import (
+	"gotor/internal/storage"
+	"gotor/internal/testutil"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func newConnTestSwarm(t *testing.T, limiter *ConnLimiter) *Swarm {
+	t.Helper()
+
+	ti := testutil.NewTorrentInfo(t, 40000, 16384, false)
+	s := NewSwarm(ti, "peer", nil, storage.NewPieceManager(ti), nil, 0, limiter)
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// waitConnStats waits until the swarm reports want
+func waitConnStats(t *testing.T, s *Swarm, want ConnStats) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.ConnStats() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats %+v, want %+v", s.ConnStats(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	l := NewConnLimiter(ConnLimits{MaxConns: 3, MaxHalfOpen: 2})
+
+	if !l.reserve(true) || !l.reserve(true) {
+		t.Fatal("half-open reservation refused below the limit")
+	}
+	if l.reserve(true) {
+		t.Fatal("more half-open connections than MaxHalfOpen")
+	}
+
+	l.opened()
+	if conns, halfOpen := l.Stats(); conns != 1 || halfOpen != 1 {
+		t.Fatalf("%d connections and %d half-open after a handshake", conns, halfOpen)
+	}
+
+	// half-open connections count against MaxConns as well
+	if !l.reserve(false) {
+		t.Fatal("incoming connection refused below the limit")
+	}
+	if l.reserve(false) || l.reserve(true) {
+		t.Fatal("more connections than MaxConns")
+	}
+
+	l.release(true)
+	l.release(false)
+	l.release(false)
+	if conns, halfOpen := l.Stats(); conns != 0 || halfOpen != 0 {
+		t.Fatalf("%d connections and %d half-open after releasing all", conns, halfOpen)
+	}
+}
+
+func TestFillKeepsToTorrentHalfOpenLimit(t *testing.T) {
+	limiter := NewConnLimiter(ConnLimits{MaxConns: 10, MaxHalfOpen: 10, MaxConnsPerTorrent: 10, MaxHalfOpenPerTorrent: 2})
+	s := newConnTestSwarm(t, limiter)
+
+	peers, accepted := silentPeers(t, 5)
+	s.AddPeers(peers)
+	s.manager.fill()
+
+	if stats := s.ConnStats(); stats.HalfOpen != 2 || stats.Known != 5 {
+		t.Fatalf("stats %+v, want 2 half-open of 5 known", stats)
+	}
+	if _, halfOpen := limiter.Stats(); halfOpen != 2 {
+		t.Errorf("limiter counts %d half-open, want 2", halfOpen)
+	}
+
+	// a second fill has no room left
+	s.manager.fill()
+	time.Sleep(100 * time.Millisecond)
+	if got := accepted(); got != 2 {
+		t.Errorf("dialed %d peers, want 2", got)
+	}
+
+	s.Close()
+	waitConnStats(t, s, ConnStats{Known: 5})
+	waitReleased(t, limiter)
+}
+
+func TestFillKeepsToGlobalLimits(t *testing.T) {
+	limiter := NewConnLimiter(ConnLimits{MaxConns: 10, MaxHalfOpen: 3, MaxConnsPerTorrent: 10, MaxHalfOpenPerTorrent: 2})
+	first := newConnTestSwarm(t, limiter)
+	second := newConnTestSwarm(t, limiter)
+
+	peers, _ := silentPeers(t, 4)
+	first.AddPeers(peers[:2])
+	second.AddPeers(peers[2:])
+	first.manager.fill()
+	second.manager.fill()
+
+	if got := first.ConnStats().HalfOpen + second.ConnStats().HalfOpen; got != 3 {
+		t.Errorf("%d half-open connections over both torrents, want 3", got)
+	}
+	if _, halfOpen := limiter.Stats(); halfOpen != 3 {
+		t.Errorf("limiter counts %d half-open, want 3", halfOpen)
+	}
+
+	first.Close()
+	second.Close()
+	waitReleased(t, limiter)
+}
+
+func TestAcceptIncomingLimit(t *testing.T) {
+	limiter := NewConnLimiter(ConnLimits{MaxConns: 10, MaxHalfOpen: 10, MaxConnsPerTorrent: 2, MaxHalfOpenPerTorrent: 2})
+	s := newConnTestSwarm(t, limiter)
+
+	if !s.manager.acceptIncoming() || !s.manager.acceptIncoming() {
+		t.Fatal("incoming connection refused below the limit")
+	}
+	if s.manager.acceptIncoming() {
+		t.Fatal("more connections than MaxConnsPerTorrent")
+	}
+	if conns, _ := limiter.Stats(); conns != 2 {
+		t.Errorf("limiter counts %d connections, want 2", conns)
+	}
+
+	pc := NewPeerConnection(NewPeer(netip.MustParseAddrPort("192.0.2.1:6881")), s.torrentInfo, "peer", nil, nil, nil)
+	s.manager.closeIncoming(pc)
+	if stats := s.ConnStats(); stats.Connected != 1 {
+		t.Errorf("stats %+v after closing one", stats)
+	}
+	if conns, _ := limiter.Stats(); conns != 1 {
+		t.Errorf("limiter counts %d connections, want 1", conns)
+	}
+}
+
+// dialed sets up the book as if fill had started dialing peer
+func dialed(t *testing.T, m *connManager, peer Peer) {
+	t.Helper()
+
+	if !m.limiter.reserve(true) {
+		t.Fatal("no room to dial")
+	}
+	m.Lock()
+	m.book[peer].dialing = true
+	m.halfOpen++
+	m.Unlock()
+}
+
+func TestConnRetryBackoff(t *testing.T) {
+	limiter := NewConnLimiter(DefaultConnLimits())
+	s := newConnTestSwarm(t, limiter)
+	m := s.manager
+
+	peer := NewPeer(netip.MustParseAddrPort("192.0.2.1:6881"))
+	m.add([]Peer{peer})
+
+	for failures := 1; failures < maxConnFailures; failures++ {
+		dialed(t, m, peer)
+		before := time.Now()
+		m.finished(peer, NewPeerConnection(peer, s.torrentInfo, "peer", nil, nil, nil), net.ErrClosed)
+
+		m.Lock()
+		entry := m.book[peer]
+		m.Unlock()
+		if entry.failures != failures {
+			t.Fatalf("%d failures recorded, want %d", entry.failures, failures)
+		}
+		want := connRetryBase << (failures - 1)
+		if wait := entry.nextAttempt.Sub(before); wait < want || wait > want+time.Second {
+			t.Errorf("after %d failures retrying in %s, want %s", failures, wait, want)
+		}
+		if len(m.candidates()) != 0 {
+			t.Error("backed off peer is a candidate")
+		}
+
+		// due again
+		m.Lock()
+		entry.nextAttempt = time.Time{}
+		m.Unlock()
+	}
+
+	dialed(t, m, peer)
+	m.finished(peer, NewPeerConnection(peer, s.torrentInfo, "peer", nil, nil, nil), net.ErrClosed)
+	if known := s.ConnStats().Known; known != 0 {
+		t.Errorf("peer kept after %d failures", maxConnFailures)
+	}
+	if conns, halfOpen := limiter.Stats(); conns != 0 || halfOpen != 0 {
+		t.Errorf("%d connections and %d half-open left", conns, halfOpen)
+	}
+}
+
+func TestConnRetryDelayCap(t *testing.T) {
+	if got := connRetryDelay(1); got != connRetryBase {
+		t.Errorf("first retry after %s, want %s", got, connRetryBase)
+	}
+	for _, failures := range []int{7, 20, 64, 1000} {
+		if got := connRetryDelay(failures); got != connRetryMax {
+			t.Errorf("after %d failures retrying in %s, want %s", failures, got, connRetryMax)
+		}
+	}
+}
+
+func TestFinishedAfterExchangeResetsFailures(t *testing.T) {
+	limiter := NewConnLimiter(DefaultConnLimits())
+	s := newConnTestSwarm(t, limiter)
+	m := s.manager
+
+	peer := NewPeer(netip.MustParseAddrPort("192.0.2.1:6881"))
+	m.add([]Peer{peer})
+	m.Lock()
+	m.book[peer].failures = 3
+	m.Unlock()
+
+	dialed(t, m, peer)
+	m.established(peer)
+	if stats := s.ConnStats(); stats.Connected != 1 || stats.HalfOpen != 0 {
+		t.Fatalf("stats %+v after the handshake", stats)
+	}
+	if conns, halfOpen := limiter.Stats(); conns != 1 || halfOpen != 0 {
+		t.Fatalf("limiter counts %d connections and %d half-open", conns, halfOpen)
+	}
+
+	pc := NewPeerConnection(peer, s.torrentInfo, "peer", nil, nil, nil)
+	pc.downloaded.Store(16384)
+	m.finished(peer, pc, net.ErrClosed)
+
+	m.Lock()
+	entry := m.book[peer]
+	m.Unlock()
+	if entry.failures != 0 {
+		t.Errorf("%d failures after a useful connection", entry.failures)
+	}
+	if conns, halfOpen := limiter.Stats(); conns != 0 || halfOpen != 0 {
+		t.Errorf("%d connections and %d half-open left", conns, halfOpen)
+	}
+}
+
+func TestPruneDropsSeedsWhenSeeding(t *testing.T) {
+	s := newConnTestSwarm(t, NewConnLimiter(DefaultConnLimits()))
+	for i := range s.torrentInfo.PieceCount() {
+		s.pieceManager.MarkAsCompleted(i)
+	}
+
+	seed := addTestConnection(t, s, 1)
+	pipeMessages(t, seed)
+	seed.peerSeed.Store(true)
+	leecher := addTestConnection(t, s, 2)
+	pipeMessages(t, leecher)
+	s.manager.add([]Peer{seed.peer})
+
+	s.manager.prune()
+
+	select {
+	case <-seed.done:
+	default:
+		t.Error("seed kept while seeding")
+	}
+	select {
+	case <-leecher.done:
+		t.Error("leecher dropped")
+	default:
+	}
+
+	s.manager.Lock()
+	useless := s.manager.book[seed.peer].useless
+	s.manager.Unlock()
+	if !useless {
+		t.Error("dropped seed not marked useless")
+	}
+}
+
+func TestPruneDropsIdlePeersOnlyWhenOthersWait(t *testing.T) {
+	s := newConnTestSwarm(t, NewConnLimiter(ConnLimits{MaxConns: 10, MaxHalfOpen: 10, MaxConnsPerTorrent: 1, MaxHalfOpenPerTorrent: 1}))
+	m := s.manager
+
+	idle := addTestConnection(t, s, 1)
+	pipeMessages(t, idle)
+	if !m.acceptIncoming() {
+		t.Fatal("no room for the connection")
+	}
+	m.Lock()
+	m.activity[idle] = peerActivity{since: time.Now().Add(-2 * connIdleLimit)}
+	m.Unlock()
+
+	// the torrent is full but nobody waits for the slot
+	m.prune()
+	select {
+	case <-idle.done:
+		t.Fatal("idle peer dropped while no one else waits")
+	default:
+	}
+
+	m.add([]Peer{NewPeer(netip.MustParseAddrPort("192.0.2.9:6881"))})
+	m.prune()
+	select {
+	case <-idle.done:
+	default:
+		t.Error("idle peer kept while another waits")
+	}
+}
@@ -0,0 +1,641 @@
+package network
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gotor/internal/torrent"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// parallel queries of an iterative lookup
+	dhtAlpha = 3
+	// buckets that did not change for this long are refreshed
+	dhtRefreshInterval = 15 * time.Minute
+	// tokens stay valid for one to two rotations
+	dhtTokenRotation = 5 * time.Minute
+	// announced peers are forgotten unless they announce again
+	dhtPeerLifetime    = 30 * time.Minute
+	maxDHTPeersPerHash = 200
+	maxDHTTorrents     = 2000
+	// get_peers answers are kept within a single UDP packet
+	maxDHTValues = 50
+)
+
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+var errDHTClosed = errors.New("dht closed")
+
+type pendingQuery struct {
+	addr     netip.AddrPort
+	response chan *krpcMessage
+}
+
+// DHT is a node of the mainline DHT (BEP 5). It answers queries from other
+// nodes, keeps a routing table and finds peers for info hashes. Only IPv4
+// is spoken
+type DHT struct {
+	sync.Mutex
+	QueryTimeout time.Duration
+	id           NodeID
+	conn         *net.UDPConn
+	table        *routingTable
+	bootstrap    []string
+	pending      map[string]pendingQuery
+	pinging      map[netip.AddrPort]struct{}
+	transaction  uint16
+	peers        map[[20]byte]map[netip.AddrPort]time.Time
+	secret       []byte
+	prevSecret   []byte
+	rotated      time.Time
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+// NewDHT listens for DHT traffic on the given UDP port, 0 picks any
+func NewDHT(port int) (*DHT, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, err
+	}
+
+	id := RandomNodeID()
+
+	return &DHT{
+		QueryTimeout: 5 * time.Second,
+		id:           id,
+		conn:         conn,
+		table:        newRoutingTable(id),
+		pending:      make(map[string]pendingQuery),
+		pinging:      make(map[netip.AddrPort]struct{}),
+		peers:        make(map[[20]byte]map[netip.AddrPort]time.Time),
+		secret:       newTokenSecret(),
+		prevSecret:   newTokenSecret(),
+		rotated:      time.Now(),
+		done:         make(chan struct{}),
+	}, nil
+}
+
+func (d *DHT) ID() NodeID {
+	return d.id
+}
+
+func (d *DHT) Port() int {
+	return d.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// NodeCount is the number of nodes in the routing table
+func (d *DHT) NodeCount() int {
+	return d.table.len()
+}
+
+// Serve handles incoming packets and keeps the routing table fresh until
+// the DHT is closed
+func (d *DHT) Serve() error {
+	go d.maintain()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := d.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		msg, err := decodeKrpc(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+		switch msg.Y {
+		case "q":
+			d.handleQuery(msg, addr)
+		case "r", "e":
+			d.deliver(msg, addr)
+		}
+	}
+}
+
+func (d *DHT) Close() {
+	d.closeOnce.Do(func() {
+		close(d.done)
+		d.conn.Close()
+	})
+}
+
+// Bootstrap fills the routing table by looking up our own id. Nodes kept
+// from an earlier run are asked first, the given host:port nodes are only
+// contacted when none of those answer
+func (d *DHT) Bootstrap(addrs []string) error {
+	d.Lock()
+	d.bootstrap = addrs
+	d.Unlock()
+
+	if d.table.len() > 0 {
+		if closest, _ := d.lookup(d.id, "find_node", nil); len(closest) > 0 {
+			return nil
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+		if err != nil {
+			log.Printf("DHT: bootstrap node %s: %v\n", addr, err)
+			continue
+		}
+
+		wg.Add(1)
+		go func(addr netip.AddrPort) {
+			defer wg.Done()
+			d.query(addr, "find_node", map[string]torrent.Node{
+				"target": {Value: string(d.id[:])},
+			})
+		}(netip.AddrPortFrom(udpAddr.AddrPort().Addr().Unmap(), udpAddr.AddrPort().Port()))
+	}
+	wg.Wait()
+
+	if d.table.len() == 0 {
+		return errors.New("no bootstrap node answered")
+	}
+
+	d.lookup(d.id, "find_node", nil)
+	return nil
+}
+
+// AddNode pings a node and adds it to the routing table when it answers
+func (d *DHT) AddNode(addr netip.AddrPort) error {
+	_, err := d.query(addr, "ping", map[string]torrent.Node{})
+	return err
+}
+
+// GetPeers looks up peers for the info hash
+func (d *DHT) GetPeers(infoHash [20]byte) ([]Peer, error) {
+	_, peers, err := d.getPeers(infoHash)
+	return peers, err
+}
+
+// Announce looks up peers for the info hash and announces that we accept
+// connections for it on port
+func (d *DHT) Announce(infoHash [20]byte, port int) ([]Peer, error) {
+	closest, peers, err := d.getPeers(infoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	for _, entry := range closest {
+		if entry.token == "" {
+			continue
+		}
+
+		wg.Add(1)
+		go func(entry *lookupEntry) {
+			defer wg.Done()
+			d.query(entry.node.addr, "announce_peer", map[string]torrent.Node{
+				"info_hash":    {Value: string(infoHash[:])},
+				"port":         {Value: port},
+				"implied_port": {Value: 0},
+				"token":        {Value: entry.token},
+			})
+		}(entry)
+	}
+	wg.Wait()
+
+	return peers, nil
+}
+
+func (d *DHT) getPeers(infoHash [20]byte) ([]*lookupEntry, []Peer, error) {
+	if d.table.len() == 0 {
+		return nil, nil, errors.New("dht routing table is empty")
+	}
+
+	closest, peers := d.lookup(NodeID(infoHash), "get_peers", map[string]torrent.Node{
+		"info_hash": {Value: string(infoHash[:])},
+	})
+
+	return closest, peers, nil
+}
+
+type lookupEntry struct {
+	node      dhtNode
+	queried   bool
+	responded bool
+	failed    bool
+	token     string
+}
+
+// lookup runs an iterative Kademlia lookup towards target, querying the
+// closest nodes not asked yet until the k closest have all answered or
+// failed. It returns the closest nodes that answered and the peers found
+// in get_peers values
+func (d *DHT) lookup(target NodeID, method string, args map[string]torrent.Node) ([]*lookupEntry, []Peer) {
+	if method == "find_node" {
+		args = map[string]torrent.Node{"target": {Value: string(target[:])}}
+	}
+
+	var mu sync.Mutex
+	entries := make(map[netip.AddrPort]*lookupEntry)
+	var shortlist []*lookupEntry
+	seenPeers := make(map[Peer]struct{})
+	var peers []Peer
+
+	add := func(node dhtNode) {
+		if node.id == d.id {
+			return
+		}
+		if _, ok := entries[node.addr]; ok {
+			return
+		}
+		entry := &lookupEntry{node: node}
+		entries[node.addr] = entry
+		shortlist = append(shortlist, entry)
+	}
+
+	for _, node := range d.table.closest(target, dhtK) {
+		add(node)
+	}
+
+	for {
+		mu.Lock()
+		sortEntries(target, shortlist)
+
+		// nodes that failed make room for the next closest ones
+		var batch []*lookupEntry
+		considered := 0
+		for _, entry := range shortlist {
+			if entry.failed {
+				continue
+			}
+			if considered == dhtK || len(batch) == dhtAlpha {
+				break
+			}
+			considered++
+
+			if !entry.queried {
+				entry.queried = true
+				batch = append(batch, entry)
+			}
+		}
+		mu.Unlock()
+
+		if len(batch) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+		for _, entry := range batch {
+			wg.Add(1)
+			go func(entry *lookupEntry) {
+				defer wg.Done()
+
+				resp, err := d.query(entry.node.addr, method, args)
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				if err != nil {
+					entry.failed = true
+					return
+				}
+
+				entry.responded = true
+				entry.token = resp["token"].AsString()
+				for _, node := range decodeCompactNodes(resp["nodes"].AsString()) {
+					add(node)
+				}
+				for _, value := range resp["values"].AsList() {
+					addr, ok := decodeCompactAddr(value.AsString())
+					if !ok || addr.Port() == 0 {
+						continue
+					}
+					peer := NewPeer(addr)
+					if _, ok := seenPeers[peer]; !ok {
+						seenPeers[peer] = struct{}{}
+						peers = append(peers, peer)
+					}
+				}
+			}(entry)
+		}
+		wg.Wait()
+
+		select {
+		case <-d.done:
+			return nil, peers
+		default:
+		}
+	}
+
+	var closest []*lookupEntry
+	for _, entry := range shortlist {
+		if entry.responded {
+			closest = append(closest, entry)
+		}
+		if len(closest) == dhtK {
+			break
+		}
+	}
+
+	return closest, peers
+}
+
+func sortEntries(target NodeID, entries []*lookupEntry) {
+	slices.SortFunc(entries, func(a, b *lookupEntry) int {
+		return target.compareDistance(a.node.id, b.node.id)
+	})
+}
+
+// query sends a KRPC query and waits for the answer. The responding node is
+// added to the routing table, a timeout counts against it
+func (d *DHT) query(addr netip.AddrPort, method string, args map[string]torrent.Node) (map[string]torrent.Node, error) {
+	d.Lock()
+	d.transaction++
+	transactionId := string(binary.BigEndian.AppendUint16(nil, d.transaction))
+	respChan := make(chan *krpcMessage, 1)
+	d.pending[transactionId] = pendingQuery{addr: addr, response: respChan}
+	d.Unlock()
+
+	defer func() {
+		d.Lock()
+		delete(d.pending, transactionId)
+		d.Unlock()
+	}()
+
+	queryArgs := make(map[string]torrent.Node, len(args)+1)
+	for k, v := range args {
+		queryArgs[k] = v
+	}
+	queryArgs["id"] = torrent.Node{Value: string(d.id[:])}
+
+	if err := d.send(&krpcMessage{T: transactionId, Y: "q", Q: method, A: queryArgs}, addr); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(d.QueryTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-d.done:
+		return nil, errDHTClosed
+	case <-timer.C:
+		d.table.failed(addr)
+		return nil, fmt.Errorf("%s query to %s timed out", method, addr)
+	case resp := <-respChan:
+		if resp.Y == "e" {
+			return nil, fmt.Errorf("%s query to %s failed: %v", method, addr, resp.E)
+		}
+
+		id, ok := nodeIdArg(resp.R, "id")
+		if !ok {
+			return nil, fmt.Errorf("%s response from %s without id", method, addr)
+		}
+		d.seen(id, addr)
+
+		return resp.R, nil
+	}
+}
+
+// deliver hands a response to the query waiting for it, answers from
+// another address than the one queried are dropped
+func (d *DHT) deliver(msg *krpcMessage, addr netip.AddrPort) {
+	d.Lock()
+	pending, ok := d.pending[msg.T]
+	if ok && pending.addr == addr {
+		delete(d.pending, msg.T)
+	}
+	d.Unlock()
+
+	if ok && pending.addr == addr {
+		pending.response <- msg
+	}
+}
+
+// seen records that a node is alive. If its bucket is full of nodes that
+// may be gone, the oldest one is pinged to make room. A busy bucket hands
+// out the same node for every newcomer, so it is only pinged once at a time
+func (d *DHT) seen(id NodeID, addr netip.AddrPort) {
+	questionable, ok := d.table.insert(dhtNode{id: id, addr: addr, lastSeen: time.Now()})
+	if !ok {
+		return
+	}
+
+	d.Lock()
+	if _, ok := d.pinging[questionable.addr]; ok {
+		d.Unlock()
+		return
+	}
+	d.pinging[questionable.addr] = struct{}{}
+	d.Unlock()
+
+	go func() {
+		d.AddNode(questionable.addr)
+
+		d.Lock()
+		delete(d.pinging, questionable.addr)
+		d.Unlock()
+	}()
+}
+
+func (d *DHT) send(msg *krpcMessage, addr netip.AddrPort) error {
+	data, err := msg.encode()
+	if err != nil {
+		return err
+	}
+
+	_, err = d.conn.WriteToUDPAddrPort(data, addr)
+	return err
+}
+
+func (d *DHT) handleQuery(msg *krpcMessage, addr netip.AddrPort) {
+	id, ok := nodeIdArg(msg.A, "id")
+	if !ok {
+		d.send(krpcErrorMessage(msg.T, krpcProtocolError, "missing id"), addr)
+		return
+	}
+
+	var resp map[string]torrent.Node
+	var errMsg *krpcMessage
+
+	switch msg.Q {
+	case "ping":
+		resp = map[string]torrent.Node{}
+	case "find_node":
+		target, ok := nodeIdArg(msg.A, "target")
+		if !ok {
+			errMsg = krpcErrorMessage(msg.T, krpcProtocolError, "missing target")
+			break
+		}
+		resp = map[string]torrent.Node{
+			"nodes": {Value: encodeCompactNodes(d.table.closest(target, dhtK))},
+		}
+	case "get_peers":
+		infoHash, ok := nodeIdArg(msg.A, "info_hash")
+		if !ok {
+			errMsg = krpcErrorMessage(msg.T, krpcProtocolError, "missing info_hash")
+			break
+		}
+		resp = d.getPeersResponse([20]byte(infoHash), addr)
+	case "announce_peer":
+		errMsg = d.handleAnnounce(msg, addr)
+		resp = map[string]torrent.Node{}
+	default:
+		errMsg = krpcErrorMessage(msg.T, krpcUnknownMethod, "unknown method")
+	}
+
+	if errMsg != nil {
+		d.send(errMsg, addr)
+		return
+	}
+
+	d.seen(id, addr)
+
+	resp["id"] = torrent.Node{Value: string(d.id[:])}
+	d.send(&krpcMessage{T: msg.T, Y: "r", R: resp}, addr)
+}
+
+func (d *DHT) getPeersResponse(infoHash [20]byte, addr netip.AddrPort) map[string]torrent.Node {
+	resp := map[string]torrent.Node{
+		"token": {Value: d.token(addr.Addr(), false)},
+	}
+
+	d.Lock()
+	var values []torrent.Node
+	for peer := range d.peers[infoHash] {
+		if len(values) == maxDHTValues {
+			break
+		}
+		values = append(values, torrent.Node{Value: encodeCompactAddr(peer)})
+	}
+	d.Unlock()
+
+	if len(values) > 0 {
+		resp["values"] = torrent.Node{Value: values}
+	} else {
+		resp["nodes"] = torrent.Node{Value: encodeCompactNodes(d.table.closest(NodeID(infoHash), dhtK))}
+	}
+
+	return resp
+}
+
+func (d *DHT) handleAnnounce(msg *krpcMessage, addr netip.AddrPort) *krpcMessage {
+	infoHash, ok := nodeIdArg(msg.A, "info_hash")
+	if !ok {
+		return krpcErrorMessage(msg.T, krpcProtocolError, "missing info_hash")
+	}
+
+	token := msg.A["token"].AsString()
+	if token != d.token(addr.Addr(), false) && token != d.token(addr.Addr(), true) {
+		return krpcErrorMessage(msg.T, krpcProtocolError, "bad token")
+	}
+
+	port := addr.Port()
+	if msg.A["implied_port"].AsInt() == 0 {
+		value := msg.A["port"].AsInt()
+		if value <= 0 || value > 65535 {
+			return krpcErrorMessage(msg.T, krpcProtocolError, "bad port")
+		}
+		port = uint16(value)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	peers, ok := d.peers[infoHash]
+	if !ok {
+		if len(d.peers) >= maxDHTTorrents {
+			return nil
+		}
+		peers = make(map[netip.AddrPort]time.Time)
+		d.peers[infoHash] = peers
+	}
+
+	peer := netip.AddrPortFrom(addr.Addr(), port)
+	if _, ok := peers[peer]; ok || len(peers) < maxDHTPeersPerHash {
+		peers[peer] = time.Now()
+	}
+
+	return nil
+}
+
+// token is handed out in get_peers answers and has to come back with
+// announce_peer from the same ip
+func (d *DHT) token(ip netip.Addr, previous bool) string {
+	d.Lock()
+	secret := d.secret
+	if previous {
+		secret = d.prevSecret
+	}
+	d.Unlock()
+
+	hash := sha1.Sum(append(append([]byte(nil), secret...), ip.AsSlice()...))
+	return string(hash[:8])
+}
+
+func newTokenSecret() []byte {
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	return secret
+}
+
+// maintain rotates token secrets, forgets old announces and refreshes stale
+// buckets
+func (d *DHT) maintain() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		}
+
+		d.Lock()
+		if time.Since(d.rotated) > dhtTokenRotation {
+			d.prevSecret = d.secret
+			d.secret = newTokenSecret()
+			d.rotated = time.Now()
+		}
+
+		for hash, peers := range d.peers {
+			for peer, announced := range peers {
+				if time.Since(announced) > dhtPeerLifetime {
+					delete(peers, peer)
+				}
+			}
+			if len(peers) == 0 {
+				delete(d.peers, hash)
+			}
+		}
+		bootstrap := d.bootstrap
+		d.Unlock()
+
+		if d.table.len() == 0 {
+			if len(bootstrap) > 0 {
+				if err := d.Bootstrap(bootstrap); err != nil {
+					log.Printf("DHT: %v\n", err)
+				}
+			}
+			continue
+		}
+
+		for _, i := range d.table.staleBuckets(dhtRefreshInterval) {
+			d.lookup(d.table.randomIdInBucket(i), "find_node", nil)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package network
+
+import (
+	"log"
+	"time"
+)
+
+// a torrent is announced to the DHT again after this long
+const dhtAnnounceInterval = 15 * time.Minute
+
+// DHTAnnouncer is the part of the DHT a swarm announces itself through
+type DHTAnnouncer interface {
+	Announce(infoHash [20]byte, port int) ([]Peer, error)
+}
+
+// RunDHT announces the torrent to the DHT until the swarm is closed and adds
+// the peers found along the way. It returns at once for private torrents
+func (s *Swarm) RunDHT(dht DHTAnnouncer, port int) {
+	if s.torrentInfo.Private() {
+		return
+	}
+
+	ticker := time.NewTicker(dhtAnnounceInterval)
+	defer ticker.Stop()
+
+	for {
+		peers, err := dht.Announce(s.InfoHash(), port)
+		if err != nil {
+			log.Printf("DHT announce failed: %v\n", err)
+		}
+		s.AddPeers(peers)
+
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package network
+
+import (
+	"gotor/internal/testutil"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingAnnouncer stands in for the DHT and counts the announces
+type countingAnnouncer struct {
+	announces atomic.Int32
+}
+
+func (ca *countingAnnouncer) Announce(infoHash [20]byte, port int) ([]Peer, error) {
+	ca.announces.Add(1)
+	return []Peer{NewPeer(netip.MustParseAddrPort("10.0.0.1:6881"))}, nil
+}
+
+func runDHT(t *testing.T, s *Swarm, dht DHTAnnouncer) <-chan struct{} {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		s.RunDHT(dht, 6881)
+		close(done)
+	}()
+
+	return done
+}
+
+func TestRunDHTSkipsPrivateTorrents(t *testing.T) {
+	s := NewSwarm(testutil.NewTorrentInfo(t, 40000, 16384, true), "peer", nil, nil, nil, 0, NewConnLimiter(DefaultConnLimits()))
+	defer s.Close()
+
+	dht := &countingAnnouncer{}
+	select {
+	case <-runDHT(t, s, dht):
+	case <-time.After(time.Second):
+		t.Fatal("RunDHT kept running for a private torrent")
+	}
+
+	if got := dht.announces.Load(); got != 0 {
+		t.Errorf("private torrent announced %d times", got)
+	}
+	if known := s.ConnStats().Known; known != 0 {
+		t.Errorf("learned %d peers from the DHT", known)
+	}
+}
+
+func TestRunDHTAnnouncesPublicTorrents(t *testing.T) {
+	s := NewSwarm(testutil.NewTorrentInfo(t, 40000, 16384, false), "peer", nil, nil, nil, 0, NewConnLimiter(DefaultConnLimits()))
+
+	dht := &countingAnnouncer{}
+	done := runDHT(t, s, dht)
+
+	deadline := time.Now().Add(time.Second)
+	for dht.announces.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Close()
+	<-done
+
+	if got := dht.announces.Load(); got != 1 {
+		t.Errorf("announced %d times, want 1", got)
+	}
+}
@@ -0,0 +1,173 @@
+package network
+
+import (
+	"crypto/rand"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// bucket size, also the number of nodes returned by lookups
+	dhtK = 8
+	// a node that failed to answer this many queries in a row is dropped
+	maxNodeFailures = 2
+	// nodes not heard from for this long are pinged before being kept
+	nodeQuestionableAfter = 15 * time.Minute
+)
+
+type bucket struct {
+	// least recently seen first
+	nodes   []dhtNode
+	changed time.Time
+}
+
+// routingTable holds the known DHT nodes in 160 buckets, bucket i keeps the
+// nodes sharing exactly i leading bits with our own id
+type routingTable struct {
+	sync.Mutex
+	self    NodeID
+	buckets [160]bucket
+}
+
+func newRoutingTable(self NodeID) *routingTable {
+	return &routingTable{self: self}
+}
+
+func (rt *routingTable) bucketIndex(id NodeID) int {
+	return min(rt.self.prefixLen(id), len(rt.buckets)-1)
+}
+
+// insert records a node that just talked to us. When its bucket is full and
+// the oldest node has not been heard from in a while, that node is returned
+// so the caller can ping it and free its place if it is gone
+func (rt *routingTable) insert(node dhtNode) (dhtNode, bool) {
+	if node.id == rt.self {
+		return dhtNode{}, false
+	}
+
+	rt.Lock()
+	defer rt.Unlock()
+
+	b := &rt.buckets[rt.bucketIndex(node.id)]
+
+	if i := slices.IndexFunc(b.nodes, func(n dhtNode) bool { return n.id == node.id }); i != -1 {
+		// an id showing up from another address is ignored
+		if b.nodes[i].addr != node.addr {
+			return dhtNode{}, false
+		}
+
+		b.nodes = slices.Delete(b.nodes, i, i+1)
+		node.failures = 0
+		b.nodes = append(b.nodes, node)
+		b.changed = time.Now()
+		return dhtNode{}, false
+	}
+
+	if len(b.nodes) < dhtK {
+		b.nodes = append(b.nodes, node)
+		b.changed = time.Now()
+		return dhtNode{}, false
+	}
+
+	if oldest := b.nodes[0]; time.Since(oldest.lastSeen) > nodeQuestionableAfter {
+		return oldest, true
+	}
+
+	return dhtNode{}, false
+}
+
+// failed counts an unanswered query against the node at addr
+func (rt *routingTable) failed(addr netip.AddrPort) {
+	rt.Lock()
+	defer rt.Unlock()
+
+	for i := range rt.buckets {
+		b := &rt.buckets[i]
+		for j := range b.nodes {
+			if b.nodes[j].addr != addr {
+				continue
+			}
+
+			b.nodes[j].failures++
+			if b.nodes[j].failures >= maxNodeFailures {
+				b.nodes = slices.Delete(b.nodes, j, j+1)
+			}
+			return
+		}
+	}
+}
+
+// closest returns up to n known nodes ordered by distance to the target
+func (rt *routingTable) closest(target NodeID, n int) []dhtNode {
+	all := rt.nodes()
+	sortByDistance(target, all)
+
+	return all[:min(n, len(all))]
+}
+
+func (rt *routingTable) nodes() []dhtNode {
+	rt.Lock()
+	defer rt.Unlock()
+
+	var all []dhtNode
+	for i := range rt.buckets {
+		all = append(all, rt.buckets[i].nodes...)
+	}
+
+	return all
+}
+
+func (rt *routingTable) len() int {
+	rt.Lock()
+	defer rt.Unlock()
+
+	count := 0
+	for i := range rt.buckets {
+		count += len(rt.buckets[i].nodes)
+	}
+
+	return count
+}
+
+// staleBuckets returns the buckets that have nodes but did not change for
+// the given time and should be refreshed
+func (rt *routingTable) staleBuckets(age time.Duration) []int {
+	rt.Lock()
+	defer rt.Unlock()
+
+	var stale []int
+	for i := range rt.buckets {
+		if len(rt.buckets[i].nodes) > 0 && time.Since(rt.buckets[i].changed) > age {
+			stale = append(stale, i)
+		}
+	}
+
+	return stale
+}
+
+// randomIdInBucket returns an id that falls into bucket i, used as the
+// target of a refresh lookup
+func (rt *routingTable) randomIdInBucket(i int) NodeID {
+	var id NodeID
+	rand.Read(id[:])
+
+	// keep the first i bits of our id and flip the next one
+	for bit := 0; bit <= i && bit < 160; bit++ {
+		mask := byte(0x80 >> (bit % 8))
+		selfBit := rt.self[bit/8] & mask
+		if bit == i {
+			selfBit ^= mask
+		}
+		id[bit/8] = id[bit/8]&^mask | selfBit
+	}
+
+	return id
+}
+
+func sortByDistance(target NodeID, nodes []dhtNode) {
+	slices.SortFunc(nodes, func(a, b dhtNode) int {
+		return target.compareDistance(a.id, b.id)
+	})
+}
@@ -0,0 +1,118 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"gotor/internal/torrent"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// dhtStateVersion is written to dht.dat and bumped whenever its layout
+// changes in a way older readers can't handle
+const dhtStateVersion = 1
+
+// DHTState is what survives a restart: our node id and the routing table.
+// It is stored as a bencoded dictionary:
+//
+//	version  int, dhtStateVersion
+//	id       20 byte node id
+//	nodes    compact node info, 26 bytes per node
+//	saved    unix time of the save
+type DHTState struct {
+	ID    NodeID
+	Saved time.Time
+	nodes []dhtNode
+}
+
+func LoadDHTState(path string) (*DHTState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	parser, err := torrent.NewParserFromData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := parser.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("invalid dht state: %w", err)
+	}
+
+	dict := root.AsDict()
+	if dict == nil {
+		return nil, errors.New("invalid dht state: not a dictionary")
+	}
+
+	if version := dict["version"].AsInt(); version < 1 || version > dhtStateVersion {
+		return nil, fmt.Errorf("unsupported dht state version %d", version)
+	}
+
+	id, ok := nodeIdArg(dict, "id")
+	if !ok {
+		return nil, errors.New("invalid dht state: bad node id")
+	}
+
+	return &DHTState{
+		ID:    id,
+		Saved: time.Unix(int64(dict["saved"].AsInt()), 0),
+		nodes: decodeCompactNodes(dict["nodes"].AsString()),
+	}, nil
+}
+
+// NewDHTFromState starts a DHT with the id and nodes of an earlier run. The
+// nodes are not trusted until they answer, Bootstrap asks them first
+func NewDHTFromState(port int, state *DHTState) (*DHT, error) {
+	d, err := NewDHT(port)
+	if err != nil {
+		return nil, err
+	}
+
+	d.id = state.ID
+	d.table = newRoutingTable(state.ID)
+	for _, node := range state.nodes {
+		// a zero last seen time makes them the first to be replaced
+		node.lastSeen = time.Time{}
+		d.table.insert(node)
+	}
+
+	return d, nil
+}
+
+func (d *DHT) State() *DHTState {
+	return &DHTState{
+		ID:    d.id,
+		Saved: time.Now(),
+		nodes: d.table.nodes(),
+	}
+}
+
+// SaveState writes the state to path, replacing the old file only once the
+// new one is complete
+func (d *DHT) SaveState(path string) error {
+	state := d.State()
+
+	data, err := torrent.Encode(torrent.Node{Value: map[string]torrent.Node{
+		"version": {Value: dhtStateVersion},
+		"id":      {Value: string(state.ID[:])},
+		"nodes":   {Value: encodeCompactNodes(state.nodes)},
+		"saved":   {Value: state.Saved.Unix()},
+	}})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
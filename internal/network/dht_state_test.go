@@ -0,0 +1,140 @@
+package network
+
+import (
+	"fmt"
+	"gotor/internal/torrent"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDHTStateRoundTrip(t *testing.T) {
+	d := newTestDHT(t)
+
+	want := make(map[netip.AddrPort]NodeID)
+	for i := range 3 {
+		node := dhtNode{
+			id:       d.table.randomIdInBucket(i),
+			addr:     netip.MustParseAddrPort(fmt.Sprintf("10.0.0.%d:6881", i+1)),
+			lastSeen: time.Now(),
+		}
+		d.table.insert(node)
+		want[node.addr] = node.id
+	}
+
+	// the directory is created on save
+	path := filepath.Join(t.TempDir(), "state", "dht.dat")
+	if err := d.SaveState(path); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := LoadDHTState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.ID != d.ID() {
+		t.Errorf("loaded id %x, want %x", state.ID, d.ID())
+	}
+	if age := time.Since(state.Saved); age < 0 || age > time.Minute {
+		t.Errorf("saved %s ago", age)
+	}
+	if len(state.nodes) != len(want) {
+		t.Fatalf("loaded %d nodes, want %d", len(state.nodes), len(want))
+	}
+	for _, node := range state.nodes {
+		if want[node.addr] != node.id {
+			t.Errorf("node %s has id %x, want %x", node.addr, node.id, want[node.addr])
+		}
+	}
+
+	restored, err := NewDHTFromState(0, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if restored.ID() != d.ID() || restored.NodeCount() != len(want) {
+		t.Errorf("restored id %x with %d nodes", restored.ID(), restored.NodeCount())
+	}
+}
+
+func TestDHTStateVersion(t *testing.T) {
+	d := newTestDHT(t)
+	path := filepath.Join(t.TempDir(), "dht.dat")
+	if err := d.SaveState(path); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser, err := torrent.NewParserFromData(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := parser.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := root.AsDict()["version"].AsInt(); version != dhtStateVersion {
+		t.Errorf("saved version %d, want %d", version, dhtStateVersion)
+	}
+}
+
+// writeDHTState encodes a state file with the given version
+func writeDHTState(t *testing.T, version int) string {
+	t.Helper()
+
+	data, err := torrent.Encode(torrent.Node{Value: map[string]torrent.Node{
+		"version": {Value: version},
+		"id":      {Value: string(make([]byte, 20))},
+		"nodes":   {Value: ""},
+		"saved":   {Value: 0},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "dht.dat")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadDHTStateWrongVersion(t *testing.T) {
+	if _, err := LoadDHTState(writeDHTState(t, dhtStateVersion)); err != nil {
+		t.Fatalf("current version: %v", err)
+	}
+
+	for _, version := range []int{0, dhtStateVersion + 1} {
+		if _, err := LoadDHTState(writeDHTState(t, version)); err == nil {
+			t.Errorf("loaded a state of version %d", version)
+		}
+	}
+}
+
+func TestLoadDHTStateCorrupt(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"garbage",
+		"d7:versioni1e2:id20:",
+		"i1e",
+		"d7:versioni1e2:id3:abc5:nodes0:5:savedi0ee",
+	} {
+		path := filepath.Join(t.TempDir(), "dht.dat")
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadDHTState(path); err == nil {
+			t.Errorf("loaded %q", data)
+		}
+	}
+
+	if _, err := LoadDHTState(filepath.Join(t.TempDir(), "missing.dat")); !os.IsNotExist(err) {
+		t.Errorf("missing file: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newTestDHT(t *testing.T) *DHT {
+	t.Helper()
+
+	d, err := NewDHT(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.QueryTimeout = time.Second
+	t.Cleanup(d.Close)
+
+	return d
+}
+
+func TestSeenPingsQuestionableNodeOnce(t *testing.T) {
+	d := newTestDHT(t)
+
+	// the oldest node of a full bucket, it never answers
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	old := time.Now().Add(-2 * nodeQuestionableAfter)
+	for i := range dhtK {
+		addr := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(40000+i))
+		if i == 0 {
+			addr = silent.LocalAddr().(*net.UDPAddr).AddrPort()
+		}
+		d.table.insert(dhtNode{id: d.table.randomIdInBucket(0), addr: addr, lastSeen: old.Add(time.Duration(i))})
+	}
+
+	for i := range 50 {
+		d.seen(d.table.randomIdInBucket(0), netip.AddrPortFrom(netip.MustParseAddr("127.0.0.2"), uint16(50000+i)))
+	}
+
+	pings := 0
+	buf := make([]byte, 1500)
+	for {
+		silent.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		if _, err := silent.Read(buf); err != nil {
+			break
+		}
+		pings++
+	}
+
+	if pings != 1 {
+		t.Errorf("questionable node got %d pings, want 1", pings)
+	}
+}
+
+func TestDHTAnnounceAndGetPeers(t *testing.T) {
+	nodes := make([]*DHT, 5)
+	for i := range nodes {
+		nodes[i] = newTestDHT(t)
+		go nodes[i].Serve()
+	}
+
+	// everyone bootstraps from the first node and learns about the others
+	// through it
+	bootstrap := []string{fmt.Sprintf("127.0.0.1:%d", nodes[0].Port())}
+	for _, d := range nodes[1:] {
+		if err := d.Bootstrap(bootstrap); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := nodes[len(nodes)-1].NodeCount(); got < 2 {
+		t.Fatalf("last node knows %d nodes", got)
+	}
+
+	infoHash := [20]byte{1, 2, 3}
+	if _, err := nodes[1].Announce(infoHash, 6881); err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err := nodes[len(nodes)-1].GetPeers(infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := NewPeer(netip.MustParseAddrPort("127.0.0.1:6881"))
+	if !slices.Contains(peers, want) {
+		t.Errorf("got peers %v, want %v", peers, want)
+	}
+}
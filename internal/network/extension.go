@@ -0,0 +1,281 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"gotor/internal/torrent"
+	"log"
+	"net"
+	"sort"
+	"sync"
+)
+
+// bit 20 from the right of the reserved field, BEP 10
+const extensionProtocolBit = 0x10
+
+const extHandshakeId byte = 0
+
+const clientVersion = "gotor 0.0.1"
+
+// how many outstanding requests we tell peers we are willing to queue
+const maxPeerRequests = 250
+
+// ExtendedHandshake is the dictionary exchanged with extended message id 0
+type ExtendedHandshake struct {
+	M            map[string]byte
+	V            string
+	P            int
+	Reqq         int
+	YourIP       net.IP
+	MetadataSize int
+}
+
+// ExtensionHandler is a per-connection instance of an extension. It receives
+// the payload of extended messages sent with the id we assigned to it
+type ExtensionHandler interface {
+	OnHandshake(hs *ExtendedHandshake) error
+	HandleMessage(payload []byte) error
+}
+
+// HandshakeExtender is implemented by handlers that add their own keys to our
+// extended handshake, ut_metadata uses it for metadata_size
+type HandshakeExtender interface {
+	ExtendHandshake(dict map[string]torrent.Node)
+}
+
+// ExtensionFactory creates the handler of an extension for one connection.
+// Returning nil leaves the extension out of that connection, it is then not
+// offered in our extended handshake either
+type ExtensionFactory func(pc *PeerConnection) ExtensionHandler
+
+type ExtensionRegistry struct {
+	sync.RWMutex
+	ids       map[string]byte
+	names     map[byte]string
+	factories map[string]ExtensionFactory
+}
+
+func NewExtensionRegistry() *ExtensionRegistry {
+	return &ExtensionRegistry{
+		ids:       make(map[string]byte),
+		names:     make(map[byte]string),
+		factories: make(map[string]ExtensionFactory),
+	}
+}
+
+// Register adds an extension under its protocol name and returns the local
+// message id peers have to use when sending it to us
+func (r *ExtensionRegistry) Register(name string, factory ExtensionFactory) (byte, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.ids[name]; ok {
+		return 0, fmt.Errorf("extension %s already registered", name)
+	}
+	if len(r.ids) >= 255 {
+		return 0, errors.New("too many extensions")
+	}
+
+	id := byte(len(r.ids) + 1)
+	r.ids[name] = id
+	r.names[id] = name
+	r.factories[name] = factory
+
+	return id, nil
+}
+
+func (r *ExtensionRegistry) ID(name string) (byte, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	id, ok := r.ids[name]
+	return id, ok
+}
+
+func (r *ExtensionRegistry) Name(id byte) (string, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	name, ok := r.names[id]
+	return name, ok
+}
+
+// Names returns the registered extension names ordered by id
+func (r *ExtensionRegistry) Names() []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	names := make([]string, 0, len(r.ids))
+	for name := range r.ids {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return r.ids[names[i]] < r.ids[names[j]]
+	})
+
+	return names
+}
+
+func (r *ExtensionRegistry) newHandlers(pc *PeerConnection) map[string]ExtensionHandler {
+	r.RLock()
+	defer r.RUnlock()
+
+	handlers := make(map[string]ExtensionHandler, len(r.factories))
+	for name, factory := range r.factories {
+		if handler := factory(pc); handler != nil {
+			handlers[name] = handler
+		}
+	}
+
+	return handlers
+}
+
+func parseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	parser, _ := torrent.NewParserFromData(payload)
+	root, err := parser.Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	dict := root.AsDict()
+	if dict == nil {
+		return nil, errors.New("extended handshake is not a dictionary")
+	}
+
+	hs := &ExtendedHandshake{
+		M:            make(map[string]byte),
+		V:            dict["v"].AsString(),
+		P:            dict["p"].AsInt(),
+		Reqq:         dict["reqq"].AsInt(),
+		MetadataSize: dict["metadata_size"].AsInt(),
+	}
+
+	for name, id := range dict["m"].AsDict() {
+		// an id of 0 means the peer disabled the extension
+		if v := id.AsInt(); v > 0 && v <= 255 {
+			hs.M[name] = byte(v)
+		}
+	}
+
+	if ip := dict["yourip"].AsString(); len(ip) == net.IPv4len || len(ip) == net.IPv6len {
+		hs.YourIP = net.IP(ip)
+	}
+
+	return hs, nil
+}
+
+func (pc *PeerConnection) sendExtendedHandshake() error {
+	m := make(map[string]torrent.Node)
+	for _, name := range pc.extensions.Names() {
+		if _, ok := pc.extHandlers[name]; !ok {
+			continue
+		}
+		id, _ := pc.extensions.ID(name)
+		m[name] = torrent.Node{Value: int(id)}
+	}
+
+	handshake := map[string]torrent.Node{
+		"m":    {Value: m},
+		"v":    {Value: clientVersion},
+		"reqq": {Value: maxPeerRequests},
+	}
+
+	if pc.listenPort > 0 {
+		handshake["p"] = torrent.Node{Value: pc.listenPort}
+	}
+
+	if addr, ok := pc.conn.RemoteAddr().(*net.TCPAddr); ok {
+		ip := addr.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		handshake["yourip"] = torrent.Node{Value: string(ip)}
+	}
+
+	for _, handler := range pc.extHandlers {
+		if extender, ok := handler.(HandshakeExtender); ok {
+			extender.ExtendHandshake(handshake)
+		}
+	}
+
+	return pc.sendExtended(extHandshakeId, handshake, nil)
+}
+
+// SendExtension sends a message of the named extension using the id the peer
+// assigned to it in its handshake
+func (pc *PeerConnection) SendExtension(name string, msg map[string]torrent.Node, trailer []byte) error {
+	id, ok := pc.PeerExtensionID(name)
+	if !ok {
+		return fmt.Errorf("peer does not support %s", name)
+	}
+
+	return pc.sendExtended(id, msg, trailer)
+}
+
+// PeerExtensionID returns the id the peer wants for the named extension
+func (pc *PeerConnection) PeerExtensionID(name string) (byte, bool) {
+	hs := pc.peerHandshake.Load()
+	if hs == nil {
+		return 0, false
+	}
+
+	id, ok := hs.M[name]
+	return id, ok
+}
+
+func (pc *PeerConnection) sendExtended(extId byte, msg map[string]torrent.Node, trailer []byte) error {
+	encoded, err := torrent.Encode(torrent.Node{Value: msg})
+	if err != nil {
+		return err
+	}
+
+	payload := make([]byte, 0, 1+len(encoded)+len(trailer))
+	payload = append(payload, extId)
+	payload = append(payload, encoded...)
+	payload = append(payload, trailer...)
+
+	return pc.sendMessage(MsgExtended, payload)
+}
+
+func (pc *PeerConnection) handleExtended(payload []byte) error {
+	if len(payload) < 1 {
+		return errors.New("empty extended message")
+	}
+
+	// without the reserved bit no handlers were created
+	if !pc.supportsExtensions {
+		log.Printf("Peer %s: extended message without extension support, ignoring\n", pc.peer.String())
+		return nil
+	}
+
+	if payload[0] == extHandshakeId {
+		hs, err := parseExtendedHandshake(payload[1:])
+		if err != nil {
+			return fmt.Errorf("invalid extended handshake: %w", err)
+		}
+		pc.peerHandshake.Store(hs)
+		if hs.P > 0 && hs.P <= 65535 {
+			pc.peerListenPort.Store(int32(hs.P))
+		}
+
+		for name, handler := range pc.extHandlers {
+			if err := handler.OnHandshake(hs); err != nil {
+				log.Printf("Peer %s: %s handshake: %v\n", pc.peer.String(), name, err)
+			}
+		}
+		return nil
+	}
+
+	name, ok := pc.extensions.Name(payload[0])
+	if !ok {
+		log.Printf("Unknown extended message id: %d\n", payload[0])
+		return nil
+	}
+
+	handler, ok := pc.extHandlers[name]
+	if !ok {
+		return nil
+	}
+
+	return handler.HandleMessage(payload[1:])
+}
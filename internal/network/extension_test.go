@@ -0,0 +1,51 @@
+package network
+
+import (
+	"gotor/internal/testutil"
+	"net/netip"
+	"testing"
+)
+
+func TestExtendedMessageWithoutExtensionSupport(t *testing.T) {
+	extensions := NewExtensionRegistry()
+	id, err := extensions.Register(UtPexName, NewUtPexExtension())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pc := NewPeerConnection(NewPeer(netip.MustParseAddrPort("192.0.2.1:6881")), testutil.NewTorrentInfo(t, 40000, 16384, false), "peer", nil, nil, extensions)
+
+	// the peer never set the reserved bit, so no handlers exist
+	if err := pc.handleExtended([]byte{id, 'd', 'e'}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.handleExtended([]byte{extHandshakeId, 'd', 'e'}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPeerExtensionIDDuringHandshake(t *testing.T) {
+	pc := NewPeerConnection(NewPeer(netip.MustParseAddrPort("192.0.2.1:6881")), testutil.NewTorrentInfo(t, 40000, 16384, false), "peer", nil, nil, nil)
+	pc.supportsExtensions = true
+
+	// extensions look the id up from their own goroutines while the message
+	// loop stores handshakes, run with -race
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 100 {
+			pc.PeerExtensionID(UtPexName)
+		}
+	}()
+
+	for range 100 {
+		if err := pc.handleExtended([]byte("\x00d1:md6:ut_pexi1eee")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+
+	if id, ok := pc.PeerExtensionID(UtPexName); !ok || id != 1 {
+		t.Errorf("got id %d, %v", id, ok)
+	}
+}
@@ -0,0 +1,125 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+)
+
+func (pc *PeerConnection) handleBitfield(payload []byte) error {
+	if pc.metadataOnly() {
+		return nil
+	}
+
+	count := pc.torrentInfo.PieceCount()
+	if len(payload) != (count+7)/8 {
+		return fmt.Errorf("invalid bitfield length: %d", len(payload))
+	}
+	// the spare bits after the last piece have to be cleared
+	if count%8 != 0 && payload[len(payload)-1]&(0xff>>uint(count%8)) != 0 {
+		return errors.New("bitfield has spare bits set")
+	}
+
+	bitfield := make([]bool, count)
+	for i := range bitfield {
+		bitfield[i] = payload[i/8]&(1<<(7-uint(i%8))) != 0
+	}
+
+	pc.pendingMu.Lock()
+	pc.pieceManager.RemovePeerBitfield(pc.peerBitfield)
+	pc.peerBitfield = bitfield
+	pc.pieceManager.AddPeerBitfield(pc.peerBitfield)
+	pc.pendingMu.Unlock()
+
+	pc.peerPieces = 0
+	for _, has := range bitfield {
+		if has {
+			pc.peerPieces++
+		}
+	}
+	pc.peerSeed.Store(pc.peerPieces == len(bitfield))
+
+	pc.FillPipeline()
+	return nil
+}
+
+// releasePieces gives back what a disconnected peer contributed to the
+// piece manager
+func (pc *PeerConnection) releasePieces() {
+	if pc.metadataOnly() {
+		return
+	}
+
+	pc.pendingMu.Lock()
+	pc.pieceManager.RemovePeerBitfield(pc.peerBitfield)
+	pc.peerBitfield = nil
+	pc.pendingMu.Unlock()
+
+	pc.releaseRequests()
+}
+
+func (pc *PeerConnection) handleHave(payload []byte) error {
+	if len(payload) != 4 {
+		return fmt.Errorf("invalid have length: %d", len(payload))
+	}
+
+	if pc.metadataOnly() {
+		return nil
+	}
+
+	index := int(binary.BigEndian.Uint32(payload))
+	if index >= pc.torrentInfo.PieceCount() {
+		return fmt.Errorf("have for piece %d out of range", index)
+	}
+
+	// peers may skip the bitfield entirely or send a short one
+	pc.pendingMu.Lock()
+	if index >= len(pc.peerBitfield) {
+		grown := make([]bool, pc.torrentInfo.PieceCount())
+		copy(grown, pc.peerBitfield)
+		pc.peerBitfield = grown
+	}
+	if !pc.peerBitfield[index] {
+		pc.peerBitfield[index] = true
+		pc.pieceManager.AddPeerPiece(index)
+		pc.peerPieces++
+		pc.peerSeed.Store(pc.peerPieces == len(pc.peerBitfield))
+	}
+	pc.pendingMu.Unlock()
+
+	pc.FillPipeline()
+	return nil
+}
+
+// sendBitfield tells the peer which pieces we have, it has to be the first
+// message after the handshake. Nothing is sent while we have no pieces
+func (pc *PeerConnection) sendBitfield() error {
+	if pc.metadataOnly() {
+		return nil
+	}
+
+	bitfield, hasPieces := pc.pieceManager.Bitfield()
+	if !hasPieces {
+		return nil
+	}
+
+	return pc.sendMessage(MsgBitfield, bitfield)
+}
+
+// SendHave queues a have message, it does not wait for the peer
+func (pc *PeerConnection) SendHave(index int) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+
+	return pc.queueMessage(MsgHave, payload)
+}
+
+// BroadcastHave announces a freshly verified piece to every connected peer
+func (s *Swarm) BroadcastHave(index int) {
+	for _, pc := range s.Peers() {
+		if err := pc.SendHave(index); err != nil {
+			log.Printf("Peer %s: failed to send have: %v\n", pc.peer.String(), err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package network
+
+import (
+	"encoding/binary"
+	"gotor/internal/storage"
+	"gotor/internal/testutil"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestBroadcastHaveDoesNotWaitForPeers(t *testing.T) {
+	ti := testutil.NewTorrentInfo(t, 40000, 16384, false)
+	s := NewSwarm(ti, "peer", nil, storage.NewPieceManager(ti), nil, 0, NewConnLimiter(DefaultConnLimits()))
+	defer s.Close()
+
+	reading := addTestConnection(t, s, 1)
+	messages := pipeMessages(t, reading)
+	go reading.runWriter()
+
+	// nothing ever reads from this peer
+	stuck := addTestConnection(t, s, 2)
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	stuck.conn = local
+	go stuck.runWriter()
+
+	done := make(chan struct{})
+	go func() {
+		s.BroadcastHave(1)
+		s.BroadcastHave(2)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("BroadcastHave waited for a peer that does not read")
+	}
+
+	for _, want := range []uint32{1, 2} {
+		msg := nextMessage(t, messages)
+		if MessageID(msg[0]) != MsgHave || binary.BigEndian.Uint32(msg[1:]) != want {
+			t.Errorf("sent %v, want have %d", msg, want)
+		}
+	}
+}
+
+func TestFullOutboxStopsConnection(t *testing.T) {
+	ti := testutil.NewTorrentInfo(t, 40000, 16384, false)
+	s := NewSwarm(ti, "peer", nil, storage.NewPieceManager(ti), nil, 0, NewConnLimiter(DefaultConnLimits()))
+	defer s.Close()
+
+	// no writer runs, so the queue only fills up
+	pc := addTestConnection(t, s, 1)
+	pipeMessages(t, pc)
+	for i := range outboxSize {
+		if err := pc.SendHave(i); err != nil {
+			t.Fatalf("have %d: %v", i, err)
+		}
+	}
+
+	if err := pc.SendHave(outboxSize); err == nil {
+		t.Fatal("queued beyond the outbox")
+	}
+	select {
+	case <-pc.done:
+	default:
+		t.Error("connection still running")
+	}
+}
+
+func TestBitfieldSpareBits(t *testing.T) {
+	// 3 pieces, the last 5 bits of the only byte are spare
+	ti := testutil.NewTorrentInfo(t, 40000, 16384, false)
+	pm := storage.NewPieceManager(ti)
+
+	tests := []struct {
+		payload byte
+		valid   bool
+	}{
+		{0xe0, true},
+		{0xa0, true},
+		{0xe1, false},
+		{0x08, false},
+	}
+
+	for _, tt := range tests {
+		pc := NewPeerConnection(NewPeer(netip.MustParseAddrPort("192.0.2.1:6881")), ti, "peer", nil, pm, nil)
+		err := pc.handleBitfield([]byte{tt.payload})
+		if tt.valid && err != nil {
+			t.Errorf("bitfield %08b: %v", tt.payload, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("bitfield %08b: accepted spare bits", tt.payload)
+		}
+		pc.releasePieces()
+	}
+}
@@ -0,0 +1,78 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// pipeMessages connects pc to an in-memory peer and returns the messages pc
+// sends it, length prefix stripped and keep-alives skipped
+func pipeMessages(t *testing.T, pc *PeerConnection) <-chan []byte {
+	t.Helper()
+
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	pc.conn = local
+
+	messages := make(chan []byte, 64)
+	go func() {
+		defer close(messages)
+		header := make([]byte, 4)
+		for {
+			if _, err := io.ReadFull(remote, header); err != nil {
+				return
+			}
+			msg := make([]byte, binary.BigEndian.Uint32(header))
+			if _, err := io.ReadFull(remote, msg); err != nil {
+				return
+			}
+			if len(msg) > 0 {
+				messages <- msg
+			}
+		}
+	}()
+
+	return messages
+}
+
+// nextMessage waits for the next message from pipeMessages
+func nextMessage(t *testing.T, messages <-chan []byte) []byte {
+	t.Helper()
+
+	select {
+	case msg, ok := <-messages:
+		if !ok {
+			t.Fatal("connection closed")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message sent")
+		return nil
+	}
+}
+
+// addTestConnection adds an established connection without a peer behind it
+// to s
+func addTestConnection(t *testing.T, s *Swarm, host int) *PeerConnection {
+	t.Helper()
+
+	addr := netip.MustParseAddrPort(fmt.Sprintf("192.0.2.%d:6881", host))
+	pc := NewPeerConnection(NewPeer(addr), s.torrentInfo, "peer", nil, s.pieceManager, nil)
+	pc.swarm = s
+	pc.established.Store(true)
+	t.Cleanup(func() { pc.Stop() })
+
+	s.Lock()
+	s.conns[pc] = struct{}{}
+	s.Unlock()
+
+	return pc
+}
@@ -0,0 +1,201 @@
+package network
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"gotor/internal/torrent"
+	"math/bits"
+	"net/netip"
+	"time"
+)
+
+// compact node info is the 20 byte id followed by a compact IPv4 address
+const compactNodeLen = 20 + 6
+
+// KRPC error codes from BEP 5
+const (
+	krpcGenericError  = 201
+	krpcServerError   = 202
+	krpcProtocolError = 203
+	krpcUnknownMethod = 204
+)
+
+type NodeID [20]byte
+
+func RandomNodeID() NodeID {
+	var id NodeID
+	rand.Read(id[:])
+	return id
+}
+
+func (id NodeID) xor(other NodeID) NodeID {
+	var d NodeID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// compareDistance orders a and b by their xor distance to id
+func (id NodeID) compareDistance(a NodeID, b NodeID) int {
+	da, db := id.xor(a), id.xor(b)
+	return bytes.Compare(da[:], db[:])
+}
+
+// prefixLen returns the number of leading bits the ids have in common
+func (id NodeID) prefixLen(other NodeID) int {
+	d := id.xor(other)
+	for i, b := range d {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return len(d) * 8
+}
+
+type dhtNode struct {
+	id       NodeID
+	addr     netip.AddrPort
+	lastSeen time.Time
+	failures int
+}
+
+// krpcMessage is a decoded KRPC message. Queries carry Q and A, responses R
+// and errors E
+type krpcMessage struct {
+	T string
+	Y string
+	Q string
+	A map[string]torrent.Node
+	R map[string]torrent.Node
+	E []torrent.Node
+}
+
+func (m *krpcMessage) encode() ([]byte, error) {
+	dict := map[string]torrent.Node{
+		"t": {Value: m.T},
+		"y": {Value: m.Y},
+	}
+
+	switch m.Y {
+	case "q":
+		dict["q"] = torrent.Node{Value: m.Q}
+		dict["a"] = torrent.Node{Value: m.A}
+	case "r":
+		dict["r"] = torrent.Node{Value: m.R}
+	case "e":
+		dict["e"] = torrent.Node{Value: m.E}
+	}
+
+	return torrent.Encode(torrent.Node{Value: dict})
+}
+
+func decodeKrpc(data []byte) (*krpcMessage, error) {
+	parser, err := torrent.NewParserFromData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := parser.Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	dict := root.AsDict()
+	if dict == nil {
+		return nil, errors.New("krpc message is not a dictionary")
+	}
+
+	msg := &krpcMessage{
+		T: dict["t"].AsString(),
+		Y: dict["y"].AsString(),
+		Q: dict["q"].AsString(),
+		A: dict["a"].AsDict(),
+		R: dict["r"].AsDict(),
+		E: dict["e"].AsList(),
+	}
+
+	if msg.T == "" {
+		return nil, errors.New("krpc message without transaction id")
+	}
+
+	switch {
+	case msg.Y == "q" && msg.A == nil:
+		return nil, errors.New("krpc query without arguments")
+	case msg.Y == "r" && msg.R == nil:
+		return nil, errors.New("krpc response without body")
+	case msg.Y != "q" && msg.Y != "r" && msg.Y != "e":
+		return nil, errors.New("unknown krpc message type")
+	}
+
+	return msg, nil
+}
+
+func krpcErrorMessage(transactionId string, code int, message string) *krpcMessage {
+	return &krpcMessage{
+		T: transactionId,
+		Y: "e",
+		E: []torrent.Node{{Value: code}, {Value: message}},
+	}
+}
+
+// nodeIdArg reads a 20 byte id from a query or response dictionary
+func nodeIdArg(dict map[string]torrent.Node, key string) (NodeID, bool) {
+	value := dict[key].AsString()
+	if len(value) != 20 {
+		return NodeID{}, false
+	}
+
+	return NodeID([]byte(value)), true
+}
+
+func encodeCompactNodes(nodes []dhtNode) string {
+	buf := make([]byte, 0, len(nodes)*compactNodeLen)
+	for _, node := range nodes {
+		if !node.addr.Addr().Is4() {
+			continue
+		}
+
+		buf = append(buf, node.id[:]...)
+		buf = append(buf, encodeCompactAddr(node.addr)...)
+	}
+
+	return string(buf)
+}
+
+func decodeCompactNodes(blob string) []dhtNode {
+	nodes := make([]dhtNode, 0, len(blob)/compactNodeLen)
+	for i := 0; i+compactNodeLen <= len(blob); i += compactNodeLen {
+		addr, ok := decodeCompactAddr(blob[i+20 : i+compactNodeLen])
+		if !ok || addr.Port() == 0 {
+			continue
+		}
+
+		nodes = append(nodes, dhtNode{
+			id:   NodeID([]byte(blob[i : i+20])),
+			addr: addr,
+		})
+	}
+
+	return nodes
+}
+
+func encodeCompactAddr(addr netip.AddrPort) string {
+	buf := addr.Addr().Unmap().AsSlice()
+	buf = binary.BigEndian.AppendUint16(buf, addr.Port())
+	return string(buf)
+}
+
+// decodeCompactAddr reads a 6 byte IPv4 or 18 byte IPv6 address
+func decodeCompactAddr(blob string) (netip.AddrPort, bool) {
+	if len(blob) != 6 && len(blob) != 18 {
+		return netip.AddrPort{}, false
+	}
+
+	ip, _ := netip.AddrFromSlice([]byte(blob[:len(blob)-2]))
+	port := binary.BigEndian.Uint16([]byte(blob[len(blob)-2:]))
+
+	return netip.AddrPortFrom(ip, port), true
+}
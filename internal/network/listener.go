@@ -0,0 +1,101 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+// IncomingHandler takes over a connection whose handshake was already read
+type IncomingHandler func(conn net.Conn, hs Handshake)
+
+// PeerListener accepts peer connections on the announced port and routes them
+// to the torrent matching the info hash of their handshake
+type PeerListener struct {
+	sync.Mutex
+	listener net.Listener
+	handlers map[[20]byte]IncomingHandler
+}
+
+func Listen(port int) (*PeerListener, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+
+	return &PeerListener{
+		listener: listener,
+		handlers: make(map[[20]byte]IncomingHandler),
+	}, nil
+}
+
+func (l *PeerListener) Port() int {
+	return l.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (l *PeerListener) Register(infoHash [20]byte, handler IncomingHandler) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.handlers[infoHash] = handler
+}
+
+func (l *PeerListener) Unregister(infoHash [20]byte) {
+	l.Lock()
+	defer l.Unlock()
+
+	delete(l.handlers, infoHash)
+}
+
+// Serve accepts connections until the listener is closed
+func (l *PeerListener) Serve() error {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		go l.handle(conn)
+	}
+}
+
+func (l *PeerListener) handle(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+
+	hs, err := ReadHandshake(conn)
+	if err != nil {
+		log.Printf("Incoming %s: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	l.Lock()
+	handler, ok := l.handlers[hs.InfoHash]
+	l.Unlock()
+
+	if !ok {
+		log.Printf("Incoming %s: unknown info hash %x\n", conn.RemoteAddr(), hs.InfoHash)
+		conn.Close()
+		return
+	}
+
+	conn.SetReadDeadline(time.Time{})
+	handler(conn, hs)
+}
+
+func (l *PeerListener) Close() error {
+	return l.listener.Close()
+}
@@ -0,0 +1,259 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	lsdAnnounceInterval = 5 * time.Minute
+	// BEP 14 asks for no more than one announce per torrent and minute
+	lsdMinAnnounceInterval = time.Minute
+	// keeps an announce within a single datagram
+	lsdMaxHashesPerMessage = 20
+)
+
+var (
+	lsdGroup4 = netip.MustParseAddrPort("239.192.152.143:6771")
+	lsdGroup6 = netip.MustParseAddrPort("[ff15::efc0:988f]:6771")
+)
+
+type lsdGroup struct {
+	addr   netip.AddrPort
+	listen *net.UDPConn
+	send   *net.UDPConn
+}
+
+// LSD finds peers on the local network through BEP 14 multicast announces.
+// Announces carrying our own cookie are ignored, multicast loops them back
+type LSD struct {
+	sync.Mutex
+	port         int
+	cookie       string
+	groups       []*lsdGroup
+	torrents     map[[20]byte]func([]Peer)
+	lastAnnounce map[[20]byte]time.Time
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+// NewLSD joins the IPv4 and IPv6 LSD groups and announces port as our peer
+// port. It only fails when neither group could be joined
+func NewLSD(port int) (*LSD, error) {
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+
+	l := &LSD{
+		port:         port,
+		cookie:       hex.EncodeToString(cookie),
+		torrents:     make(map[[20]byte]func([]Peer)),
+		lastAnnounce: make(map[[20]byte]time.Time),
+		done:         make(chan struct{}),
+	}
+
+	var errs []error
+	for _, addr := range []netip.AddrPort{lsdGroup4, lsdGroup6} {
+		group, err := joinLSDGroup(addr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		l.groups = append(l.groups, group)
+	}
+
+	if len(l.groups) == 0 {
+		return nil, fmt.Errorf("lsd: %w", errors.Join(errs...))
+	}
+
+	return l, nil
+}
+
+func joinLSDGroup(addr netip.AddrPort) (*lsdGroup, error) {
+	network := "udp4"
+	if addr.Addr().Is6() {
+		network = "udp6"
+	}
+
+	listen, err := net.ListenMulticastUDP(network, nil, net.UDPAddrFromAddrPort(addr))
+	if err != nil {
+		return nil, err
+	}
+
+	send, err := net.ListenUDP(network, nil)
+	if err != nil {
+		listen.Close()
+		return nil, err
+	}
+
+	return &lsdGroup{addr: addr, listen: listen, send: send}, nil
+}
+
+// LSDRegistry is the part of LSD a swarm registers with
+type LSDRegistry interface {
+	Register(infoHash [20]byte, onPeers func([]Peer))
+}
+
+// RegisterLSD announces the torrent on the local network and adds the peers
+// announcing it. Private torrents are not registered
+func (s *Swarm) RegisterLSD(lsd LSDRegistry) {
+	if s.torrentInfo.Private() {
+		return
+	}
+
+	lsd.Register(s.InfoHash(), s.AddPeers)
+}
+
+// Register announces the torrent on the local network and hands peers
+// announcing it to onPeers
+func (l *LSD) Register(infoHash [20]byte, onPeers func([]Peer)) {
+	l.Lock()
+	l.torrents[infoHash] = onPeers
+	l.Unlock()
+
+	l.announce()
+}
+
+func (l *LSD) Unregister(infoHash [20]byte) {
+	l.Lock()
+	defer l.Unlock()
+
+	delete(l.torrents, infoHash)
+	delete(l.lastAnnounce, infoHash)
+}
+
+// Serve listens for announces and repeats ours until Close
+func (l *LSD) Serve() error {
+	var wg sync.WaitGroup
+	for _, group := range l.groups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.readLoop(group); err != nil {
+				log.Printf("LSD %s stopped: %v\n", group.addr, err)
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(lsdAnnounceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			wg.Wait()
+			return nil
+		case <-ticker.C:
+			l.announce()
+		}
+	}
+}
+
+func (l *LSD) readLoop(group *lsdGroup) error {
+	buf := make([]byte, 1500)
+	for {
+		n, src, err := group.listen.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		l.handle(buf[:n], src)
+	}
+}
+
+func (l *LSD) handle(data []byte, src netip.AddrPort) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil || req.Method != "BT-SEARCH" {
+		return
+	}
+
+	if req.Header.Get("Cookie") == l.cookie {
+		return
+	}
+
+	port, err := strconv.Atoi(req.Header.Get("Port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return
+	}
+	peer := NewPeer(netip.AddrPortFrom(src.Addr(), uint16(port)))
+
+	for _, value := range req.Header.Values("Infohash") {
+		raw, err := hex.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(raw) != 20 {
+			continue
+		}
+
+		l.Lock()
+		onPeers, ok := l.torrents[[20]byte(raw)]
+		l.Unlock()
+
+		if ok {
+			log.Printf("LSD: %s announced %x\n", peer.String(), raw)
+			onPeers([]Peer{peer})
+		}
+	}
+}
+
+// announce sends a BT-SEARCH for every torrent not announced within the last
+// minute to both groups
+func (l *LSD) announce() {
+	l.Lock()
+	var hashes [][20]byte
+	for hash := range l.torrents {
+		if time.Since(l.lastAnnounce[hash]) >= lsdMinAnnounceInterval {
+			hashes = append(hashes, hash)
+			l.lastAnnounce[hash] = time.Now()
+		}
+	}
+	l.Unlock()
+
+	for len(hashes) > 0 {
+		batch := hashes[:min(len(hashes), lsdMaxHashesPerMessage)]
+		hashes = hashes[len(batch):]
+
+		for _, group := range l.groups {
+			msg := l.searchMessage(group.addr, batch)
+			if _, err := group.send.WriteToUDPAddrPort(msg, group.addr); err != nil {
+				log.Printf("LSD announce to %s failed: %v\n", group.addr, err)
+			}
+		}
+	}
+}
+
+func (l *LSD) searchMessage(host netip.AddrPort, hashes [][20]byte) []byte {
+	var b strings.Builder
+	b.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&b, "Host: %s\r\n", host)
+	fmt.Fprintf(&b, "Port: %d\r\n", l.port)
+	for _, hash := range hashes {
+		fmt.Fprintf(&b, "Infohash: %x\r\n", hash)
+	}
+	fmt.Fprintf(&b, "cookie: %s\r\n", l.cookie)
+	b.WriteString("\r\n\r\n")
+
+	return []byte(b.String())
+}
+
+func (l *LSD) Close() {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		for _, group := range l.groups {
+			group.listen.Close()
+			group.send.Close()
+		}
+	})
+}
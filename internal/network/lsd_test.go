@@ -0,0 +1,48 @@
+package network
+
+import (
+	"gotor/internal/testutil"
+	"testing"
+)
+
+// recordingLSD stands in for LSD and keeps the registered torrents
+type recordingLSD struct {
+	torrents map[[20]byte]func([]Peer)
+}
+
+func (rl *recordingLSD) Register(infoHash [20]byte, onPeers func([]Peer)) {
+	rl.torrents[infoHash] = onPeers
+}
+
+func TestRegisterLSDSkipsPrivateTorrents(t *testing.T) {
+	s := NewSwarm(testutil.NewTorrentInfo(t, 40000, 16384, true), "peer", nil, nil, nil, 0, NewConnLimiter(DefaultConnLimits()))
+	defer s.Close()
+
+	lsd := &recordingLSD{torrents: make(map[[20]byte]func([]Peer))}
+	s.RegisterLSD(lsd)
+
+	if len(lsd.torrents) != 0 {
+		t.Error("private torrent registered with LSD")
+	}
+}
+
+func TestRegisterLSDAddsPeers(t *testing.T) {
+	s := NewSwarm(testutil.NewTorrentInfo(t, 40000, 16384, false), "peer", nil, nil, nil, 0, NewConnLimiter(DefaultConnLimits()))
+	defer s.Close()
+
+	lsd := &recordingLSD{torrents: make(map[[20]byte]func([]Peer))}
+	s.RegisterLSD(lsd)
+
+	onPeers, ok := lsd.torrents[s.InfoHash()]
+	if !ok {
+		t.Fatal("public torrent not registered with LSD")
+	}
+	peer, err := ParsePeer("192.168.1.20:6881")
+	if err != nil {
+		t.Fatal(err)
+	}
+	onPeers([]Peer{peer})
+	if known := s.ConnStats().Known; known != 1 {
+		t.Errorf("%d peers known, want the one from LSD", known)
+	}
+}
@@ -0,0 +1,209 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	metadataPieceSize = 16 * 1024
+	// sanity limit so a lying peer can't make us allocate gigabytes
+	maxMetadataSize = 64 * 1024 * 1024
+	// how long a requested metadata piece is considered taken by a peer
+	metadataRequestTimeout = 20 * time.Second
+)
+
+// Metadata holds the info dictionary of a torrent as exchanged over ut_metadata
+// (BEP 9). It is shared by every connection of a torrent: while fetching, peers
+// fill in pieces; once complete it is used to serve requests
+type Metadata struct {
+	sync.Mutex
+	infoHash  [20]byte
+	raw       []byte
+	size      int
+	pieces    [][]byte
+	requested []time.Time
+	done      chan struct{}
+}
+
+func NewMetadata(infoHash [20]byte) *Metadata {
+	return &Metadata{
+		infoHash: infoHash,
+		done:     make(chan struct{}),
+	}
+}
+
+// NewMetadataFromRaw creates an already complete metadata for serving
+func NewMetadataFromRaw(infoHash [20]byte, raw string) *Metadata {
+	m := NewMetadata(infoHash)
+	m.raw = []byte(raw)
+	m.size = len(raw)
+	close(m.done)
+
+	return m
+}
+
+func (m *Metadata) Done() <-chan struct{} {
+	return m.done
+}
+
+func (m *Metadata) Complete() bool {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.raw != nil
+}
+
+// Raw returns the verified info dictionary, empty until complete
+func (m *Metadata) Raw() string {
+	m.Lock()
+	defer m.Unlock()
+
+	return string(m.raw)
+}
+
+func (m *Metadata) Size() int {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.size
+}
+
+// SetSize sets the total size announced by a peer. The first valid size wins
+// until the assembled metadata fails to verify, a peer reporting something
+// else is ignored meanwhile
+func (m *Metadata) SetSize(size int) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if size <= 0 || size > maxMetadataSize {
+		return fmt.Errorf("invalid metadata size: %d", size)
+	}
+
+	if m.size != 0 {
+		if m.size != size {
+			return fmt.Errorf("metadata size mismatch: have %d, peer says %d", m.size, size)
+		}
+		return nil
+	}
+
+	m.size = size
+	count := (size + metadataPieceSize - 1) / metadataPieceSize
+	m.pieces = make([][]byte, count)
+	m.requested = make([]time.Time, count)
+
+	return nil
+}
+
+// NextRequest returns a piece that is neither received nor recently requested.
+// Pieces in skip, those the asking peer rejected, are left for others
+func (m *Metadata) NextRequest(skip map[int]bool) (int, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.raw != nil {
+		return 0, false
+	}
+
+	now := time.Now()
+	for i := range m.pieces {
+		if m.pieces[i] != nil || skip[i] {
+			continue
+		}
+		if !m.requested[i].IsZero() && now.Sub(m.requested[i]) < metadataRequestTimeout {
+			continue
+		}
+
+		m.requested[i] = now
+		return i, true
+	}
+
+	return 0, false
+}
+
+// Reject makes a piece available for other peers again. It reports whether
+// the index names a piece at all
+func (m *Metadata) Reject(index int) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	if index < 0 || index >= len(m.requested) {
+		return false
+	}
+
+	m.requested[index] = time.Time{}
+	return true
+}
+
+// AddPiece stores a received piece. Once every piece is in, the assembled
+// bytes are checked against the info hash; on mismatch everything is dropped,
+// the size included since a peer may have lied about it
+func (m *Metadata) AddPiece(index int, data []byte) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.raw != nil {
+		return nil
+	}
+
+	if index < 0 || index >= len(m.pieces) {
+		return fmt.Errorf("metadata piece %d out of range", index)
+	}
+
+	if len(data) != m.pieceLength(index) {
+		m.requested[index] = time.Time{}
+		return fmt.Errorf("metadata piece %d has wrong length %d", index, len(data))
+	}
+
+	m.pieces[index] = bytes.Clone(data)
+
+	for _, piece := range m.pieces {
+		if piece == nil {
+			return nil
+		}
+	}
+
+	raw := bytes.Join(m.pieces, nil)
+	if sha1.Sum(raw) != m.infoHash {
+		m.size = 0
+		m.pieces = nil
+		m.requested = nil
+		return errors.New("metadata hash mismatch")
+	}
+
+	m.raw = raw
+	m.pieces = nil
+	m.requested = nil
+	close(m.done)
+
+	return nil
+}
+
+// Piece returns a piece of complete metadata for serving
+func (m *Metadata) Piece(index int) ([]byte, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	// the index comes from the peer, compare before multiplying so a huge
+	// one can't overflow
+	if m.raw == nil || index < 0 || index >= (len(m.raw)+metadataPieceSize-1)/metadataPieceSize {
+		return nil, false
+	}
+
+	start := index * metadataPieceSize
+	end := min(start+metadataPieceSize, len(m.raw))
+
+	return m.raw[start:end], true
+}
+
+func (m *Metadata) pieceLength(index int) int {
+	if index == len(m.pieces)-1 {
+		return m.size - index*metadataPieceSize
+	}
+
+	return metadataPieceSize
+}
@@ -0,0 +1,127 @@
+package network
+
+import (
+	"errors"
+	"gotor/internal/torrent"
+	"log"
+	"sync"
+	"time"
+)
+
+// metadataFetcher dials the peers of a magnet link for the info dictionary,
+// counting its connections against the limits like a swarm does
+type metadataFetcher struct {
+	sync.Mutex
+	torrentInfo torrent.TorrentInfo
+	myPeerId    string
+	metadata    *Metadata
+	limiter     *ConnLimiter
+	queue       []Peer
+	active      map[*PeerConnection]struct{}
+	conns       int
+	halfOpen    int
+	freed       chan struct{}
+}
+
+// FetchMetadata downloads the info dictionary of torrentInfo from peers over
+// ut_metadata. The connections it opened are stopped when it returns
+func FetchMetadata(torrentInfo torrent.TorrentInfo, myPeerId string, peers []Peer, limiter *ConnLimiter, timeout time.Duration) (string, error) {
+	f := &metadataFetcher{
+		torrentInfo: torrentInfo,
+		myPeerId:    myPeerId,
+		metadata:    NewMetadata(torrentInfo.InfoHash()),
+		limiter:     limiter,
+		queue:       peers,
+		active:      make(map[*PeerConnection]struct{}),
+		freed:       make(chan struct{}, 1),
+	}
+	defer f.stop()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	// retries dials the global limits turned down
+	ticker := time.NewTicker(connManagerTick)
+	defer ticker.Stop()
+
+	for {
+		if !f.fill() {
+			return "", errors.New("no peer sent the metadata")
+		}
+
+		select {
+		case <-f.metadata.Done():
+			return f.metadata.Raw(), nil
+		case <-deadline.C:
+			return "", errors.New("timed out waiting for peers")
+		case <-f.freed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// fill dials queued peers until a limit is reached. It reports false once
+// every peer was tried and none is connected anymore
+func (f *metadataFetcher) fill() bool {
+	f.Lock()
+	defer f.Unlock()
+
+	limits := f.limiter.Limits()
+	for len(f.queue) > 0 {
+		if f.conns+f.halfOpen >= limits.MaxConnsPerTorrent || f.halfOpen >= limits.MaxHalfOpenPerTorrent {
+			break
+		}
+		if !f.limiter.reserve(true) {
+			break
+		}
+
+		pc := NewMetadataPeerConnection(f.queue[0], f.torrentInfo, f.myPeerId, f.metadata)
+		pc.onEstablished = f.established
+		f.queue = f.queue[1:]
+		f.active[pc] = struct{}{}
+		f.halfOpen++
+		go f.run(pc)
+	}
+
+	return len(f.queue) > 0 || len(f.active) > 0
+}
+
+func (f *metadataFetcher) run(pc *PeerConnection) {
+	if err := pc.Start(); err != nil {
+		log.Printf("Metadata peer %s: %v\n", pc.peer.String(), err)
+	}
+
+	f.Lock()
+	if pc.established.Load() {
+		f.conns--
+		f.limiter.release(false)
+	} else {
+		f.halfOpen--
+		f.limiter.release(true)
+	}
+	delete(f.active, pc)
+	f.Unlock()
+
+	select {
+	case f.freed <- struct{}{}:
+	default:
+	}
+}
+
+func (f *metadataFetcher) established() {
+	f.Lock()
+	defer f.Unlock()
+
+	f.halfOpen--
+	f.conns++
+	f.limiter.opened()
+}
+
+func (f *metadataFetcher) stop() {
+	f.Lock()
+	defer f.Unlock()
+
+	f.queue = nil
+	for pc := range f.active {
+		pc.Stop()
+	}
+}
@@ -0,0 +1,141 @@
+package network
+
+import (
+	"fmt"
+	"gotor/internal/storage"
+	"gotor/internal/testutil"
+	"gotor/internal/torrent"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// silentPeers listens for count peers that accept connections and never
+// answer, it returns them and the number of connections they accepted
+func silentPeers(t *testing.T, count int) ([]Peer, func() int) {
+	t.Helper()
+
+	var mu sync.Mutex
+	accepted := 0
+	var peers []Peer
+	for range count {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				t.Cleanup(func() { conn.Close() })
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}()
+
+		peer, err := ParsePeer(listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers = append(peers, peer)
+	}
+
+	return peers, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return accepted
+	}
+}
+
+// waitReleased fails unless limiter drops back to no connections
+func waitReleased(t *testing.T, limiter *ConnLimiter) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conns, halfOpen := limiter.Stats()
+		if conns == 0 && halfOpen == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections and %d half-open left", conns, halfOpen)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFetchMetadata(t *testing.T) {
+	ti := testutil.NewTorrentInfo(t, 40000, 16384, false)
+
+	extensions := NewExtensionRegistry()
+	if _, err := extensions.Register(UtMetadataName, NewUtMetadataExtension(NewMetadataFromRaw(ti.InfoHash(), ti.InfoRaw()))); err != nil {
+		t.Fatal(err)
+	}
+	seed := NewSwarm(ti, "seed", nil, storage.NewPieceManager(ti), extensions, 0, NewConnLimiter(DefaultConnLimits()))
+	defer seed.Close()
+
+	listener, err := Listen(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	listener.Register(ti.InfoHash(), seed.HandleIncoming)
+	go listener.Serve()
+
+	peer, err := ParsePeer(fmt.Sprintf("127.0.0.1:%d", listener.Port()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter := NewConnLimiter(DefaultConnLimits())
+	magnet := torrent.NewTorrentInfoFromMagnet(&torrent.Magnet{InfoHash: ti.InfoHash()})
+	raw, err := FetchMetadata(*magnet, "leech", []Peer{peer}, limiter, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw != ti.InfoRaw() {
+		t.Error("fetched metadata differs from the info dictionary")
+	}
+
+	waitReleased(t, limiter)
+}
+
+func TestFetchMetadataKeepsToLimits(t *testing.T) {
+	peers, accepted := silentPeers(t, 6)
+
+	limiter := NewConnLimiter(ConnLimits{MaxConns: 10, MaxHalfOpen: 2, MaxConnsPerTorrent: 10, MaxHalfOpenPerTorrent: 10})
+	magnet := torrent.NewTorrentInfoFromMagnet(&torrent.Magnet{InfoHash: [20]byte{1}})
+
+	start := time.Now()
+	if _, err := FetchMetadata(*magnet, "leech", peers, limiter, 500*time.Millisecond); err == nil {
+		t.Fatal("fetched metadata from silent peers")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("returned after %s", elapsed)
+	}
+
+	if got := accepted(); got != 2 {
+		t.Errorf("dialed %d peers at once, want 2", got)
+	}
+
+	waitReleased(t, limiter)
+}
+
+func TestFetchMetadataGivesUpWithoutPeers(t *testing.T) {
+	limiter := NewConnLimiter(DefaultConnLimits())
+	magnet := torrent.NewTorrentInfoFromMagnet(&torrent.Magnet{InfoHash: [20]byte{1}})
+
+	start := time.Now()
+	if _, err := FetchMetadata(*magnet, "leech", nil, limiter, time.Minute); err == nil {
+		t.Fatal("fetched metadata without peers")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("returned after %s", elapsed)
+	}
+}
@@ -0,0 +1,115 @@
+package network
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"gotor/internal/testutil"
+	"gotor/internal/torrent"
+	"math"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestMetadataPiece(t *testing.T) {
+	raw := strings.Repeat("x", metadataPieceSize+100)
+	m := NewMetadataFromRaw(sha1.Sum([]byte(raw)), raw)
+
+	if piece, ok := m.Piece(0); !ok || len(piece) != metadataPieceSize {
+		t.Fatalf("piece 0: got %d bytes, ok %v", len(piece), ok)
+	}
+	if piece, ok := m.Piece(1); !ok || len(piece) != 100 {
+		t.Fatalf("piece 1: got %d bytes, ok %v", len(piece), ok)
+	}
+
+	for _, index := range []int{-1, 2, 562949953421313, math.MaxInt} {
+		if _, ok := m.Piece(index); ok {
+			t.Errorf("piece %d: expected no data", index)
+		}
+	}
+}
+
+func TestMetadataDropsSizeOnHashMismatch(t *testing.T) {
+	raw := strings.Repeat("x", metadataPieceSize+100)
+	m := NewMetadata(sha1.Sum([]byte(raw)))
+
+	// the first peer lies about the size
+	if err := m.SetSize(100); err != nil {
+		t.Fatal(err)
+	}
+	if index, ok := m.NextRequest(nil); !ok || index != 0 {
+		t.Fatalf("got request %d, %v", index, ok)
+	}
+	if err := m.AddPiece(0, []byte(raw[:100])); err == nil {
+		t.Fatal("expected a hash mismatch")
+	}
+
+	if err := m.SetSize(len(raw)); err != nil {
+		t.Fatalf("the right size was refused after the mismatch: %v", err)
+	}
+	for i := range 2 {
+		index, ok := m.NextRequest(nil)
+		if !ok || index != i {
+			t.Fatalf("got request %d, %v, want %d", index, ok, i)
+		}
+		end := min((i+1)*metadataPieceSize, len(raw))
+		if err := m.AddPiece(i, []byte(raw[i*metadataPieceSize:end])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if m.Raw() != raw {
+		t.Error("metadata did not complete")
+	}
+}
+
+func TestUtMetadataRequestsAnotherPieceAfterReject(t *testing.T) {
+	raw := strings.Repeat("x", 3*metadataPieceSize)
+	metadata := NewMetadata(sha1.Sum([]byte(raw)))
+
+	extensions := NewExtensionRegistry()
+	if _, err := extensions.Register(UtMetadataName, NewUtMetadataExtension(metadata)); err != nil {
+		t.Fatal(err)
+	}
+
+	pc := NewPeerConnection(NewPeer(netip.MustParseAddrPort("192.0.2.1:6881")), testutil.NewTorrentInfo(t, 40000, 16384, false), "peer", nil, nil, extensions)
+	pc.supportsExtensions = true
+	pc.extHandlers = extensions.newHandlers(pc)
+	messages := pipeMessages(t, pc)
+
+	// requested piece as seen by the peer
+	requested := func() int {
+		t.Helper()
+		msg := nextMessage(t, messages)
+		parser, _ := torrent.NewParserFromData(msg[2:])
+		root, err := parser.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root.AsDict()["piece"].AsInt()
+	}
+
+	// the message loop runs elsewhere, the pipe blocks until the peer reads
+	handle := func(payload string) <-chan error {
+		errs := make(chan error, 1)
+		go func() { errs <- pc.handleExtended([]byte(payload)) }()
+		return errs
+	}
+
+	errs := handle(fmt.Sprintf("\x00d1:md11:ut_metadatai3ee13:metadata_sizei%dee", len(raw)))
+	if first, second := requested(), requested(); first != 0 || second != 1 {
+		t.Fatalf("requested %d and %d, want 0 and 1", first, second)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	id, _ := extensions.ID(UtMetadataName)
+	errs = handle(fmt.Sprintf("%cd8:msg_typei2e5:piecei0ee", id))
+	if next := requested(); next != 2 {
+		t.Errorf("requested %d after the reject, want 2", next)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
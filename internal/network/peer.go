@@ -1,12 +1,41 @@
 package network
 
-import "fmt"
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
 
+// Peer is the address of a remote peer, IPv4 or IPv6
 type Peer struct {
-	ip   string
-	port uint16
+	addr netip.AddrPort
 }
 
-func (p *Peer) String() string {
-	return fmt.Sprintf("%s:%d", p.ip, p.port)
+// NewPeer creates a peer, IPv4 addresses mapped into IPv6 are unmapped so
+// the same peer always compares equal
+func NewPeer(addr netip.AddrPort) Peer {
+	return Peer{addr: netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())}
+}
+
+func (p Peer) AddrPort() netip.AddrPort {
+	return p.addr
+}
+
+func (p Peer) String() string {
+	return p.addr.String()
+}
+
+// ParsePeer parses a "host:port" address such as the x.pe entries of a magnet
+// link. Host names are resolved
+func ParsePeer(addr string) (Peer, error) {
+	if addrPort, err := netip.ParseAddrPort(addr); err == nil {
+		return NewPeer(addrPort), nil
+	}
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return Peer{}, fmt.Errorf("invalid peer address %s: %w", addr, err)
+	}
+
+	return NewPeer(tcpAddr.AddrPort()), nil
 }
@@ -2,6 +2,7 @@ package network
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/binary"
 	"errors"
@@ -11,11 +12,20 @@ import (
 	"io"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type MessageID byte
 
+// the largest message other than a piece we accept, a bitfield of 32M pieces
+const maxMessageLength = 4 * 1024 * 1024
+
+// messages queued for the writer of a connection, a peer that lets this many
+// pile up is not reading and gets dropped
+const outboxSize = 256
+
 const (
 	MsgChoke         MessageID = iota // 0
 	MsgUnchoke                        // 1
@@ -26,13 +36,8 @@ const (
 	MsgRequest                        // 6
 	MsgPiece                          // 7
 	MsgCancel                         // 8
-)
 
-type PeerConnectionState byte
-
-const (
-	Idle PeerConnectionState = iota
-	Downloading
+	MsgExtended MessageID = 20
 )
 
 type Handshake struct {
@@ -44,80 +49,242 @@ type Handshake struct {
 }
 
 type PeerConnection struct {
-	torrentInfo            torrent.TorrentInfo
-	peer                   Peer
-	conn                   net.Conn
-	state                  PeerConnectionState
-	pieceManager           *storage.PieceManager
-	fileManager            *storage.FileManager
-	targetPipeline         int
-	downloadedBytesInPiece int64
-	currentPiece           int
-	currentOffset          int
-	inFlight               int
-	peerBitfield           []bool
-	myPeerId               string
-	pieceBuffer            []byte
+	torrentInfo    torrent.TorrentInfo
+	peer           Peer
+	conn           net.Conn
+	pieceManager   *storage.PieceManager
+	fileManager    *storage.FileManager
+	targetPipeline int
+	// guards pending and peerBitfield, the timers refill the pipeline from
+	// their own goroutine
+	pendingMu sync.Mutex
+	// outstanding requests and when they were sent
+	pending      map[storage.Block]time.Time
+	peerBitfield []bool
+	peerPieces   int
+	myPeerId     string
+	incoming     bool
+
+	supportsExtensions bool
+	extensions         *ExtensionRegistry
+	extHandlers        map[string]ExtensionHandler
+	listenPort         int
+	metadata           *Metadata
+	snubTimeout        time.Duration
+
+	writeMu        sync.Mutex
+	uploadMu       sync.Mutex
+	amChoking      bool
+	peerInterested bool
+	uploadQueue    []blockRequest
+	uploadSignal   chan struct{}
+	// messages sent from outside the message loop of this connection
+	outbox   chan []byte
+	done     chan struct{}
+	stopOnce sync.Once
+
+	swarm *Swarm
+	// called once the handshake is done, the connection manager stops
+	// counting the connection as half-open
+	onEstablished func()
+	established   atomic.Bool
+	peerChoking   atomic.Bool
+	amInterested  atomic.Bool
+	peerSeed      atomic.Bool
+	// listen port from the extended handshake of a peer that connected to us
+	peerListenPort atomic.Int32
+	snubbed        atomic.Bool
+	// extended handshake of the peer, stored by the message loop and read by
+	// extensions sending from their own goroutines
+	peerHandshake atomic.Pointer[ExtendedHandshake]
+	// unix nanoseconds of the last write and of the last requested block
+	// that arrived
+	lastWrite atomic.Int64
+	lastBlock atomic.Int64
+	// payload bytes exchanged with this peer, the choker ranks peers by them
+	downloaded atomic.Uint64
+	uploaded   atomic.Uint64
 }
 
-func NewPeerConnection(peer Peer, torrentInfo torrent.TorrentInfo, myPeerId string, fileManager *storage.FileManager, pieceManager *storage.PieceManager) *PeerConnection {
+func NewPeerConnection(peer Peer, torrentInfo torrent.TorrentInfo, myPeerId string, fileManager *storage.FileManager, pieceManager *storage.PieceManager, extensions *ExtensionRegistry) *PeerConnection {
+	if extensions == nil {
+		extensions = NewExtensionRegistry()
+	}
+
 	pc := &PeerConnection{
 		torrentInfo:    torrentInfo,
 		peer:           peer,
 		myPeerId:       myPeerId,
-		pieceBuffer:    make([]byte, torrentInfo.PieceLength()),
 		pieceManager:   pieceManager,
 		fileManager:    fileManager,
 		targetPipeline: 64,
+		pending:        make(map[storage.Block]time.Time),
+		extensions:     extensions,
+		amChoking:      true,
+		uploadSignal:   make(chan struct{}, 1),
+		outbox:         make(chan []byte, outboxSize),
+		done:           make(chan struct{}),
+		snubTimeout:    DefaultSnubTimeout,
 	}
+	pc.peerChoking.Store(true)
 
 	return pc
 }
 
-func (pc *PeerConnection) performHandshake() error {
+// NewIncomingPeerConnection wraps a connection accepted by PeerListener
+func NewIncomingPeerConnection(conn net.Conn, hs Handshake, torrentInfo torrent.TorrentInfo, myPeerId string, fileManager *storage.FileManager, pieceManager *storage.PieceManager, extensions *ExtensionRegistry) (*PeerConnection, error) {
+	peer, err := ParsePeer(conn.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+
+	pc := NewPeerConnection(peer, torrentInfo, myPeerId, fileManager, pieceManager, extensions)
+	pc.conn = conn
+	pc.incoming = true
+	pc.supportsExtensions = hs.Reserved[5]&extensionProtocolBit != 0
+
+	log.Printf("Incoming connection. Peer ID: %s", hs.PeerId)
+	return pc, nil
+}
+
+// NewMetadataPeerConnection creates a connection that only fetches the info
+// dictionary over ut_metadata and closes once the shared metadata is complete
+func NewMetadataPeerConnection(peer Peer, torrentInfo torrent.TorrentInfo, myPeerId string, metadata *Metadata) *PeerConnection {
+	extensions := NewExtensionRegistry()
+	extensions.Register(UtMetadataName, NewUtMetadataExtension(metadata))
+
+	return &PeerConnection{
+		torrentInfo: torrentInfo,
+		peer:        peer,
+		myPeerId:    myPeerId,
+		metadata:    metadata,
+		extensions:  extensions,
+		amChoking:   true,
+		outbox:      make(chan []byte, outboxSize),
+		done:        make(chan struct{}),
+	}
+}
+
+// SetListenPort sets the port advertised as "p" in the extended handshake
+func (pc *PeerConnection) SetListenPort(port int) {
+	pc.listenPort = port
+}
+
+func (pc *PeerConnection) metadataOnly() bool {
+	return pc.pieceManager == nil
+}
+
+func (pc *PeerConnection) newHandshake() Handshake {
 	// create handshake struct
 	hs := Handshake{
 		PStrLen:  19,
 		Reserved: [8]byte{},
 		InfoHash: pc.torrentInfo.InfoHash(),
 	}
+	hs.Reserved[5] |= extensionProtocolBit
 	copy(hs.PStr[:], "BitTorrent protocol")
 	copy(hs.PeerId[:], pc.myPeerId)
 
-	conn, err := net.DialTimeout("tcp", pc.peer.String(), 5*time.Second)
+	return hs
+}
+
+// ReadHandshake reads a handshake and checks the protocol string
+func ReadHandshake(r io.Reader) (Handshake, error) {
+	var response Handshake
+	if err := binary.Read(r, binary.BigEndian, &response); err != nil {
+		return response, err
+	}
+
+	if response.PStrLen != 19 {
+		return response, errors.New(fmt.Sprintf("invalid pstrlen: %v\n", response.PStrLen))
+	}
+	if string(response.PStr[:]) != "BitTorrent protocol" {
+		return response, errors.New(fmt.Sprintf("invalid protocol string: %v\n", response.PStr[:]))
+	}
+
+	return response, nil
+}
+
+func (pc *PeerConnection) performHandshake() error {
+	// Stop leaves the connection to Start until the handshake is done, so
+	// the dial and the handshake watch done themselves
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-pc.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", pc.peer.String())
 	if err != nil {
 		return err
 	}
 	pc.conn = conn
+	stopClosing := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stopClosing()
 
-	err = binary.Write(pc.conn, binary.BigEndian, hs)
+	pc.conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer pc.conn.SetDeadline(time.Time{})
+
+	err = binary.Write(pc.conn, binary.BigEndian, pc.newHandshake())
 	if err != nil {
 		return err
 	}
 
-	var response Handshake
-	binary.Read(pc.conn, binary.BigEndian, &response)
-
-	if response.PStrLen != 19 {
-		return errors.New(fmt.Sprintf("invalid pstrlen: %v\n", response.PStrLen))
-	}
-	if string(response.PStr[:]) != "BitTorrent protocol" {
-		return errors.New(fmt.Sprintf("invalid protocol string: %v\n", response.PStr[:]))
+	response, err := ReadHandshake(pc.conn)
+	if err != nil {
+		return err
 	}
 	if response.InfoHash != pc.torrentInfo.InfoHash() {
 		return errors.New(fmt.Sprintf("info hash mismatch. Peer has wrong file: %v\n", response.InfoHash[:]))
 	}
 
+	pc.supportsExtensions = response.Reserved[5]&extensionProtocolBit != 0
+
 	log.Printf("Handshake ok. Peer ID: %s", response.PeerId)
 	return nil
 }
 
+// answerHandshake replies to a peer that connected to us, its handshake was
+// already consumed by the listener
+func (pc *PeerConnection) answerHandshake() error {
+	pc.conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	defer pc.conn.SetWriteDeadline(time.Time{})
+
+	return binary.Write(pc.conn, binary.BigEndian, pc.newHandshake())
+}
+
 func (pc *PeerConnection) runMessageLoop() error {
-	interestedMsg := [5]byte{0, 0, 0, 1, 2}
-	binary.Write(pc.conn, binary.BigEndian, interestedMsg)
-	log.Println("Sent interested message")
+	if err := pc.sendBitfield(); err != nil {
+		return err
+	}
+	// queued messages only go out after the bitfield
+	go pc.runWriter()
+
+	if pc.supportsExtensions {
+		pc.extHandlers = pc.extensions.newHandlers(pc)
+		if err := pc.sendExtendedHandshake(); err != nil {
+			return err
+		}
+	} else if pc.metadataOnly() {
+		return errors.New("peer does not support the extension protocol")
+	}
+
+	if !pc.metadataOnly() {
+		if err := pc.sendMessage(MsgInterested, nil); err != nil {
+			return err
+		}
+		pc.amInterested.Store(true)
+		log.Println("Sent interested message")
+	}
 
 	for {
+		pc.conn.SetReadDeadline(time.Now().Add(peerReadTimeout))
+
 		var length int32
 		err := binary.Read(pc.conn, binary.BigEndian, &length)
 		if err != nil {
@@ -135,63 +302,147 @@ func (pc *PeerConnection) runMessageLoop() error {
 		}
 		id := idBuf[0]
 
+		if err := checkMessageLength(MessageID(id), length); err != nil {
+			return err
+		}
+
 		var payload []byte
 		if length > 1 && id != 7 {
 			payload = make([]byte, length-1)
-			io.ReadFull(pc.conn, payload)
+			if _, err := io.ReadFull(pc.conn, payload); err != nil {
+				return err
+			}
 		}
-		//log.Printf("Msg: ID=%d Len=%d ", id, length)
 
 		switch MessageID(id) {
 		case MsgChoke:
 			log.Println("Choke")
-			if pc.currentPiece != -1 {
-				pc.pieceManager.MarkAsFailed(pc.currentPiece)
+			pc.peerChoking.Store(true)
+			if pc.metadataOnly() {
+				continue
 			}
-			pc.resetState()
+			pc.releaseRequests()
 
 		case MsgUnchoke:
 			log.Println("Unchoke")
-			pc.tryRequestNextPiece()
+			pc.peerChoking.Store(false)
+			if pc.metadataOnly() {
+				continue
+			}
 			pc.FillPipeline()
 		case MsgInterested:
 			log.Println("Interested")
+			pc.uploadMu.Lock()
+			pc.peerInterested = true
+			pc.uploadMu.Unlock()
 		case MsgNotInterested:
 			log.Println("Not interested")
+			pc.uploadMu.Lock()
+			pc.peerInterested = false
+			pc.uploadMu.Unlock()
 		case MsgHave:
-			//pieceIndex := binary.BigEndian.Uint32(payload[:4])
-			//og.Printf("Have piece #%d\n", pieceIndex)
+			if err := pc.handleHave(payload); err != nil {
+				return err
+			}
 		case MsgBitfield:
 			log.Printf("Bitfield (%d bytes)\n", len(payload))
-			pc.peerBitfield = make([]bool, len(payload)*8)
-			for i, b := range payload {
-				for bit := 0; bit < 8; bit++ {
-					if b&(1<<(7-uint(bit))) != 0 {
-						pc.peerBitfield[i*8+bit] = true
-					}
-				}
+			if err := pc.handleBitfield(payload); err != nil {
+				return err
 			}
 		case MsgRequest:
-			//log.Println("Request")
+			if pc.metadataOnly() {
+				continue
+			}
+			if err := pc.handleRequest(payload); err != nil {
+				return err
+			}
 		case MsgPiece:
-			//log.Println("Piece")
-			pc.HandlePiece(int(length))
+			if pc.metadataOnly() {
+				if _, err := io.CopyN(io.Discard, pc.conn, int64(length-1)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := pc.HandlePiece(int(length)); err != nil {
+				return err
+			}
 		case MsgCancel:
-			log.Println("Cancel")
+			if err := pc.handleCancel(payload); err != nil {
+				return err
+			}
+		case MsgExtended:
+			if err := pc.handleExtended(payload); err != nil {
+				return err
+			}
 		default:
 			log.Printf("Unknown id: %d\n", id)
 		}
 	}
+}
+
+// checkMessageLength rejects lengths no honest peer sends before anything
+// is allocated for them. Pieces carry at most one block
+func checkMessageLength(id MessageID, length int32) error {
+	limit := int32(maxMessageLength)
+	if id == MsgPiece {
+		limit = maxRequestLength + 9
+	}
+
+	if length < 1 || length > limit {
+		return fmt.Errorf("invalid length %d for message %d", length, id)
+	}
+
 	return nil
 }
 
 func (pc *PeerConnection) Start() error {
 	defer pc.Stop()
-	err := pc.performHandshake()
+	defer pc.releasePieces()
+	var err error
+	if pc.conn == nil {
+		err = pc.performHandshake()
+	} else {
+		err = pc.answerHandshake()
+	}
 	if err != nil {
+		// Stop only closes established connections
+		if pc.conn != nil {
+			pc.conn.Close()
+		}
 		return err
 	}
 
+	pc.established.Store(true)
+	if pc.onEstablished != nil {
+		pc.onEstablished()
+	}
+	select {
+	case <-pc.done:
+		// stopped while the handshake was in progress
+		return pc.conn.Close()
+	default:
+	}
+
+	pc.lastWrite.Store(time.Now().UnixNano())
+	go pc.runTimers()
+
+	if !pc.metadataOnly() {
+		go pc.runUploader()
+	}
+
+	if pc.metadataOnly() {
+		finished := make(chan struct{})
+		defer close(finished)
+
+		go func() {
+			select {
+			case <-pc.metadata.Done():
+				pc.Stop()
+			case <-finished:
+			}
+		}()
+	}
+
 	err = pc.runMessageLoop()
 	if err != nil {
 		return err
@@ -201,34 +452,83 @@ func (pc *PeerConnection) Start() error {
 }
 
 func (pc *PeerConnection) Stop() error {
-	if pc.conn != nil {
-		return pc.conn.Close()
+	var err error
+	pc.stopOnce.Do(func() {
+		close(pc.done)
+		// before the handshake the connection belongs to Start, which
+		// closes it itself once it notices done
+		if pc.established.Load() {
+			err = pc.conn.Close()
+		}
+	})
+	return err
+}
+
+func (pc *PeerConnection) sendMessage(id MessageID, payload []byte) error {
+	return pc.write(frameMessage(id, payload))
+}
+
+// queueMessage hands a message to the writer of the connection. Other
+// connections use it so a peer that does not read cannot stall them
+func (pc *PeerConnection) queueMessage(id MessageID, payload []byte) error {
+	select {
+	case pc.outbox <- frameMessage(id, payload):
+		return nil
+	default:
+		pc.Stop()
+		return errors.New("peer does not read its messages")
+	}
+}
+
+// runWriter sends queued messages until the connection is stopped
+func (pc *PeerConnection) runWriter() {
+	for {
+		select {
+		case <-pc.done:
+			return
+		case buf := <-pc.outbox:
+			if err := pc.write(buf); err != nil {
+				log.Printf("Peer %s: %v\n", pc.peer.String(), err)
+				pc.Stop()
+				return
+			}
+		}
 	}
-	return nil
+}
+
+func frameMessage(id MessageID, payload []byte) []byte {
+	buf := make([]byte, 5+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(1+len(payload)))
+	buf[4] = byte(id)
+	copy(buf[5:], payload)
+
+	return buf
+}
+
+func (pc *PeerConnection) write(buf []byte) error {
+	pc.writeMu.Lock()
+	defer pc.writeMu.Unlock()
+
+	pc.conn.SetWriteDeadline(time.Now().Add(peerWriteTimeout))
+	_, err := pc.conn.Write(buf)
+	if err == nil {
+		pc.lastWrite.Store(time.Now().UnixNano())
+	}
+	return err
 }
 
 func (pc *PeerConnection) RequestBlock(pieceIndex int, blockOffset int, blockLength int) {
-	request := struct {
-		msgLen uint32
-		id     byte
-		index  uint32
-		offset uint32
-		length uint32
-	}{
-		msgLen: 13,
-		id:     6, // request
-		index:  uint32(pieceIndex),
-		offset: uint32(blockOffset),
-		length: uint32(blockLength),
-	}
-
-	binary.Write(pc.conn, binary.BigEndian, request)
-	//log.Printf("Sent request: Piece=%d Offset=%d Length=%d\n", pieceIndex, blockOffset, blockLength)
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(pieceIndex))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(blockOffset))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(blockLength))
+
+	pc.sendMessage(MsgRequest, payload)
 }
 
 func (pc *PeerConnection) HandlePiece(messageLength int) error {
-	if messageLength < 9 {
-		log.Println("piece message too short")
+	if messageLength < 9 || messageLength-9 > maxRequestLength {
+		return fmt.Errorf("invalid piece message length: %d", messageLength)
 	}
 
 	header := struct {
@@ -238,61 +538,73 @@ func (pc *PeerConnection) HandlePiece(messageLength int) error {
 
 	err := binary.Read(pc.conn, binary.BigEndian, &header)
 	if err != nil {
-		log.Println("Error reading piece header")
+		return err
 	}
 
-	blockSize := messageLength - 9
-	blockData := make([]byte, blockSize)
+	blockData := make([]byte, messageLength-9)
 
 	n, err := io.ReadFull(pc.conn, blockData)
 	if err != nil {
-		log.Println("Error reading block data")
-
-		pc.pieceManager.MarkAsFailed(pc.currentPiece)
-		pc.resetState()
-		return nil
+		return err
 	}
 
 	pc.pieceManager.AddBytes(uint64(n))
+	pc.downloaded.Add(uint64(n))
 
-	if header.Begin+uint32(n) > uint32(len(pc.pieceBuffer)) {
-		log.Println("Buffer overflow")
-	}
+	block := storage.Block{Index: int(header.Index), Begin: int(header.Begin), Length: n}
+	pc.pendingMu.Lock()
+	_, ok := pc.pending[block]
+	delete(pc.pending, block)
+	pc.pendingMu.Unlock()
 
-	copy(pc.pieceBuffer[header.Begin:], blockData)
+	if !ok {
+		// cancelled or never asked for, the bytes still count as downloaded
+		return nil
+	}
 
-	pc.inFlight--
-	pc.downloadedBytesInPiece += int64(len(blockData))
+	pc.lastBlock.Store(time.Now().UnixNano())
+	if pc.snubbed.Swap(false) {
+		log.Printf("Peer %s: delivering again\n", pc.peer.String())
+	}
 
-	if pc.downloadedBytesInPiece >= pc.torrentInfo.PieceLength() {
-		log.Printf("Piece %d downloaded. Verifying\n", pc.currentPiece)
+	result, err := pc.pieceManager.BlockReceived(pc.peer.String(), block, blockData)
+	if err != nil {
+		log.Printf("Peer %s: %v\n", pc.peer.String(), err)
+	}
 
-		if pc.verifyPiece(pc.currentPiece) {
-			log.Println("Hash match. Writing to disk")
+	if len(result.Cancel) > 0 && pc.swarm != nil {
+		pc.swarm.cancelBlock(result.Cancel, block)
+	}
 
-			globalOffset := int64(pc.currentPiece) * pc.torrentInfo.PieceLength()
-			pc.fileManager.Write(globalOffset, pc.pieceBuffer)
-			pc.pieceManager.MarkAsCompleted(pc.currentPiece)
-		} else {
-			log.Printf("Hash mismatch. Dropping piece %d\n", pc.currentPiece)
-		}
+	if result.Complete {
+		pc.completePiece(block.Index, result.Piece)
+	}
 
-		pc.state = Idle
-		pc.inFlight = 0
-		pc.currentOffset = 0
+	pc.FillPipeline()
+	return nil
+}
 
-		pc.tryRequestNextPiece()
-		pc.FillPipeline()
+func (pc *PeerConnection) completePiece(index int, piece []byte) {
+	log.Printf("Piece %d downloaded. Verifying\n", index)
 
-		return nil
+	if !pc.verifyPiece(index, piece) {
+		log.Printf("Hash mismatch. Dropping piece %d\n", index)
+		pc.pieceManager.MarkAsFailed(index)
+		return
 	}
 
-	pc.FillPipeline()
-	return nil
+	log.Println("Hash match. Writing to disk")
+
+	globalOffset := int64(index) * pc.torrentInfo.PieceLength()
+	pc.fileManager.Write(globalOffset, piece)
+	pc.pieceManager.MarkAsCompleted(index)
+	if pc.swarm != nil {
+		pc.swarm.BroadcastHave(index)
+	}
 }
 
-func (pc *PeerConnection) verifyPiece(index int) bool {
-	calculatedHash := sha1.Sum(pc.pieceBuffer)
+func (pc *PeerConnection) verifyPiece(index int, piece []byte) bool {
+	calculatedHash := sha1.Sum(piece)
 
 	offset := index * 20
 	if offset+20 > len(pc.torrentInfo.Pieces()) {
@@ -304,54 +616,67 @@ func (pc *PeerConnection) verifyPiece(index int) bool {
 	return bytes.Equal(calculatedHash[:], []byte(expectedHash))
 }
 
-func (pc *PeerConnection) tryRequestNextPiece() {
-	if len(pc.peerBitfield) == 0 {
+// FillPipeline keeps up to targetPipeline block requests outstanding. Blocks
+// come from the piece manager, so several peers can work on the same piece
+func (pc *PeerConnection) FillPipeline() {
+	if pc.peerChoking.Load() {
 		return
 	}
 
-	if pc.state == Downloading {
-		return
+	target := pc.targetPipeline
+	if pc.snubbed.Load() {
+		// one request at a time until the peer delivers again
+		target = 1
 	}
 
-	nextPieceOpt, ok := pc.pieceManager.GetNextPieceToDownload(pc.peerBitfield)
-	if !ok {
-		log.Println("No work")
-		return
+	pc.pendingMu.Lock()
+	want := target - len(pc.pending)
+	var blocks []storage.Block
+	if want > 0 && len(pc.peerBitfield) > 0 {
+		blocks = pc.pieceManager.PickBlocks(pc.peer.String(), pc.peerBitfield, want)
 	}
+	for _, block := range blocks {
+		pc.pending[block] = time.Now()
+	}
+	pc.pendingMu.Unlock()
 
-	pc.state = Downloading
-
-	pc.currentPiece = nextPieceOpt
-	pc.currentOffset = 0
-	pc.downloadedBytesInPiece = 0
-
-	clear(pc.pieceBuffer)
-	log.Printf("Assigned piece %d. Starting\n", pc.currentPiece)
+	for _, block := range blocks {
+		pc.RequestBlock(block.Index, block.Begin, block.Length)
+	}
 }
 
-func (pc *PeerConnection) FillPipeline() {
-	for pc.inFlight < pc.targetPipeline {
-		if int64(pc.currentOffset) >= pc.torrentInfo.PieceLength() {
-			break
-		}
+// cancelRequest withdraws an outstanding request, the endgame uses it once
+// another peer delivered the block
+func (pc *PeerConnection) cancelRequest(block storage.Block) {
+	pc.pendingMu.Lock()
+	_, ok := pc.pending[block]
+	delete(pc.pending, block)
+	pc.pendingMu.Unlock()
 
-		bytesLeft := pc.torrentInfo.PieceLength() - int64(pc.currentOffset)
-		size := min(16*1024, bytesLeft)
+	if !ok {
+		return
+	}
 
-		// those int type conversions are killing me man
-		// what was I thinking
-		pc.RequestBlock(pc.currentPiece, pc.currentOffset, int(size))
+	pc.sendCancel(block)
+}
 
-		pc.currentOffset += int(size)
-		pc.inFlight++
-	}
+// sendCancel queues the cancel, the endgame sends it from the message loop of
+// the peer that delivered the block
+func (pc *PeerConnection) sendCancel(block storage.Block) {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(block.Index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(block.Begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(block.Length))
+
+	pc.queueMessage(MsgCancel, payload)
 }
 
-func (pc *PeerConnection) resetState() {
-	pc.state = Idle
-	pc.inFlight = 0
-	pc.currentPiece = -1
-	pc.currentOffset = 0
-	pc.downloadedBytesInPiece = 0
-	clear(pc.pieceBuffer)
+// releaseRequests hands our outstanding requests back to the piece manager,
+// blocks already received stay with their piece
+func (pc *PeerConnection) releaseRequests() {
+	pc.pendingMu.Lock()
+	defer pc.pendingMu.Unlock()
+
+	pc.pieceManager.ReleaseBlocks(pc.peer.String())
+	clear(pc.pending)
 }
@@ -0,0 +1,66 @@
+package network
+
+import (
+	"gotor/internal/testutil"
+	"math"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCheckMessageLength(t *testing.T) {
+	tests := []struct {
+		id     MessageID
+		length int32
+		ok     bool
+	}{
+		{MsgHave, 5, true},
+		{MsgBitfield, maxMessageLength, true},
+		{MsgBitfield, maxMessageLength + 1, false},
+		{MsgExtended, math.MaxInt32, false},
+		{MsgPiece, maxRequestLength + 9, true},
+		{MsgPiece, maxRequestLength + 10, false},
+		{MsgRequest, -1, false},
+	}
+
+	for _, tt := range tests {
+		err := checkMessageLength(tt.id, tt.length)
+		if (err == nil) != tt.ok {
+			t.Errorf("id %d length %d: got %v", tt.id, tt.length, err)
+		}
+	}
+}
+
+// closeRecorder notes whether the connection was closed
+type closeRecorder struct {
+	net.Conn
+	closed atomic.Bool
+}
+
+// RemoteAddr stands in for the address net.Pipe lacks
+func (c *closeRecorder) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 6881}
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed.Store(true)
+	return c.Conn.Close()
+}
+
+func TestFailedHandshakeClosesConnection(t *testing.T) {
+	local, remote := net.Pipe()
+	remote.Close()
+
+	conn := &closeRecorder{Conn: local}
+	pc, err := NewIncomingPeerConnection(conn, Handshake{}, testutil.NewTorrentInfo(t, 40000, 16384, false), "peer", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pc.Start(); err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+	if !conn.closed.Load() {
+		t.Fatal("connection left open")
+	}
+}
@@ -0,0 +1,162 @@
+package network
+
+import (
+	"fmt"
+	"gotor/internal/storage"
+	"gotor/internal/torrent"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Swarm is the set of live connections of one torrent together with the
+// state they share
+type Swarm struct {
+	sync.Mutex
+	// SnubTimeout is how long a peer may leave our requests unanswered
+	// before we stop relying on it
+	SnubTimeout  time.Duration
+	torrentInfo  torrent.TorrentInfo
+	myPeerId     string
+	fileManager  *storage.FileManager
+	pieceManager *storage.PieceManager
+	extensions   *ExtensionRegistry
+	listenPort   int
+	conns        map[*PeerConnection]struct{}
+	pex          map[*PeerConnection]*utPex
+	manager      *connManager
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+// NewSwarm creates the swarm of a torrent. Its connections count against
+// limiter, which is shared with the other torrents
+func NewSwarm(torrentInfo torrent.TorrentInfo, myPeerId string, fileManager *storage.FileManager, pieceManager *storage.PieceManager, extensions *ExtensionRegistry, listenPort int, limiter *ConnLimiter) *Swarm {
+	s := &Swarm{
+		SnubTimeout:  DefaultSnubTimeout,
+		torrentInfo:  torrentInfo,
+		myPeerId:     myPeerId,
+		fileManager:  fileManager,
+		pieceManager: pieceManager,
+		extensions:   extensions,
+		listenPort:   listenPort,
+		conns:        make(map[*PeerConnection]struct{}),
+		pex:          make(map[*PeerConnection]*utPex),
+		done:         make(chan struct{}),
+	}
+	s.manager = newConnManager(s, limiter)
+
+	return s
+}
+
+func (s *Swarm) InfoHash() [20]byte {
+	return s.torrentInfo.InfoHash()
+}
+
+func (s *Swarm) Done() <-chan struct{} {
+	return s.done
+}
+
+// AddPeers is where peers from trackers, the DHT, peer exchange and LSD end
+// up. They go into the address book and are dialed by RunConnections
+func (s *Swarm) AddPeers(peers []Peer) {
+	s.manager.add(peers)
+}
+
+// HandleIncoming is the IncomingHandler registered with PeerListener
+func (s *Swarm) HandleIncoming(conn net.Conn, hs Handshake) {
+	pc, err := NewIncomingPeerConnection(conn, hs, s.torrentInfo, s.myPeerId, s.fileManager, s.pieceManager, s.extensions)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if !s.manager.acceptIncoming() {
+		log.Printf("Peer %s: connection limit reached, refusing\n", pc.peer.String())
+		conn.Close()
+		return
+	}
+	defer s.manager.closeIncoming(pc)
+
+	if err := s.run(pc); err != nil {
+		log.Printf("Peer %s: %v\n", pc.peer.String(), err)
+	}
+
+	// run returns without starting the connection for duplicates and once
+	// the swarm is closed, closing twice is harmless
+	conn.Close()
+}
+
+func (s *Swarm) run(pc *PeerConnection) error {
+	pc.swarm = s
+	pc.SetListenPort(s.listenPort)
+	pc.snubTimeout = s.SnubTimeout
+
+	s.Lock()
+	select {
+	case <-s.done:
+		s.Unlock()
+		return net.ErrClosed
+	default:
+	}
+	for other := range s.conns {
+		if other.peer == pc.peer {
+			s.Unlock()
+			return fmt.Errorf("already connected to %s", pc.peer.String())
+		}
+	}
+	s.conns[pc] = struct{}{}
+	s.Unlock()
+
+	defer func() {
+		s.Lock()
+		delete(s.conns, pc)
+		delete(s.pex, pc)
+		s.Unlock()
+	}()
+
+	return pc.Start()
+}
+
+// Peers returns the connections that finished their handshake
+func (s *Swarm) Peers() []*PeerConnection {
+	s.Lock()
+	defer s.Unlock()
+
+	peers := make([]*PeerConnection, 0, len(s.conns))
+	for pc := range s.conns {
+		if pc.established.Load() {
+			peers = append(peers, pc)
+		}
+	}
+
+	return peers
+}
+
+// cancelBlock sends a cancel to the given peers for a block that already
+// arrived from someone else
+func (s *Swarm) cancelBlock(peers []string, block storage.Block) {
+	for _, pc := range s.Peers() {
+		if slices.Contains(peers, pc.peer.String()) {
+			pc.cancelRequest(block)
+		}
+	}
+}
+
+func (s *Swarm) Close() {
+	s.closeOnce.Do(func() {
+		s.Lock()
+		close(s.done)
+		conns := make([]*PeerConnection, 0, len(s.conns))
+		for pc := range s.conns {
+			conns = append(conns, pc)
+		}
+		s.Unlock()
+
+		for _, pc := range conns {
+			pc.Stop()
+		}
+	})
+}
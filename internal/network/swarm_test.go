@@ -0,0 +1,84 @@
+package network
+
+import (
+	"encoding/binary"
+	"gotor/internal/storage"
+	"gotor/internal/testutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandleIncomingClosesUnstartedConnection(t *testing.T) {
+	s := NewSwarm(testutil.NewTorrentInfo(t, 40000, 16384, false), "peer", nil, nil, nil, 0, NewConnLimiter(DefaultConnLimits()))
+	s.Close()
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	conn := &closeRecorder{Conn: local}
+	s.HandleIncoming(conn, Handshake{})
+
+	if !conn.closed.Load() {
+		t.Fatal("connection to a closed swarm left open")
+	}
+	if stats := s.ConnStats(); stats.Connected != 0 {
+		t.Fatalf("connection still counted: %+v", stats)
+	}
+}
+
+func TestCancelBlockDoesNotWaitForPeers(t *testing.T) {
+	ti := testutil.NewTorrentInfo(t, 40000, 16384, false)
+	s := NewSwarm(ti, "peer", nil, storage.NewPieceManager(ti), nil, 0, NewConnLimiter(DefaultConnLimits()))
+	defer s.Close()
+
+	block := storage.Block{Index: 1, Begin: 0, Length: 16384}
+
+	reading := addTestConnection(t, s, 1)
+	messages := pipeMessages(t, reading)
+	go reading.runWriter()
+	reading.pending[block] = time.Now()
+
+	// nothing ever reads from this peer
+	stuck := addTestConnection(t, s, 2)
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	stuck.conn = local
+	go stuck.runWriter()
+	stuck.pending[block] = time.Now()
+
+	done := make(chan struct{})
+	go func() {
+		s.cancelBlock([]string{stuck.peer.String(), reading.peer.String()}, block)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("cancelBlock waited for a peer that does not read")
+	}
+
+	msg := nextMessage(t, messages)
+	if MessageID(msg[0]) != MsgCancel || len(msg) != 13 {
+		t.Fatalf("sent %v, want a cancel", msg)
+	}
+	got := storage.Block{
+		Index:  int(binary.BigEndian.Uint32(msg[1:5])),
+		Begin:  int(binary.BigEndian.Uint32(msg[5:9])),
+		Length: int(binary.BigEndian.Uint32(msg[9:13])),
+	}
+	if got != block {
+		t.Errorf("cancelled %+v, want %+v", got, block)
+	}
+
+	for _, pc := range []*PeerConnection{reading, stuck} {
+		pc.pendingMu.Lock()
+		if _, ok := pc.pending[block]; ok {
+			t.Errorf("peer %s still waits for the block", pc.peer.String())
+		}
+		pc.pendingMu.Unlock()
+	}
+}
@@ -0,0 +1,106 @@
+package network
+
+import (
+	"gotor/internal/storage"
+	"log"
+	"time"
+)
+
+const (
+	// peers send at least a keep-alive every two minutes, a connection
+	// silent for longer than this is dead
+	peerReadTimeout  = 3 * time.Minute
+	peerWriteTimeout = 30 * time.Second
+	// we send a keep-alive when nothing else was sent for this long
+	keepAliveInterval = 2 * time.Minute
+	// a block not delivered in time goes back to the picker
+	requestTimeout = 2 * time.Minute
+	// a peer delivering none of our requests for this long is snubbing us
+	DefaultSnubTimeout = time.Minute
+	peerTimerInterval  = 5 * time.Second
+)
+
+// runTimers sends keep-alives and watches our requests until the connection
+// is stopped
+func (pc *PeerConnection) runTimers() {
+	ticker := time.NewTicker(peerTimerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pc.done:
+			return
+		case <-ticker.C:
+		}
+
+		pc.checkTimers()
+	}
+}
+
+func (pc *PeerConnection) checkTimers() {
+	if time.Since(time.Unix(0, pc.lastWrite.Load())) >= keepAliveInterval {
+		if err := pc.sendKeepAlive(); err != nil {
+			log.Printf("Peer %s: failed to send keep-alive: %v\n", pc.peer.String(), err)
+		}
+	}
+
+	if !pc.metadataOnly() {
+		pc.expireRequests()
+	}
+}
+
+// sendKeepAlive sends an empty message, it has no id
+func (pc *PeerConnection) sendKeepAlive() error {
+	return pc.write([]byte{0, 0, 0, 0})
+}
+
+// expireRequests cancels requests the peer kept us waiting on for too long
+// and hands the blocks back to the piece manager. When nothing at all
+// arrived within the snub timeout every request is withdrawn and the peer
+// only gets one request at a time until it delivers again. The freed room
+// is refilled right away
+func (pc *PeerConnection) expireRequests() {
+	now := time.Now()
+	lastBlock := time.Unix(0, pc.lastBlock.Load())
+
+	pc.pendingMu.Lock()
+	var expired []storage.Block
+	snub := false
+	for block, requested := range pc.pending {
+		// time spent waiting on this request without any block arriving
+		waiting := now.Sub(requested)
+		if sinceBlock := now.Sub(lastBlock); sinceBlock < waiting {
+			waiting = sinceBlock
+		}
+		if waiting >= pc.snubTimeout {
+			snub = true
+		}
+		if now.Sub(requested) >= requestTimeout {
+			expired = append(expired, block)
+		}
+	}
+
+	if snub && !pc.snubbed.Load() {
+		pc.snubbed.Store(true)
+		log.Printf("Peer %s: snubbed us, withdrawing %d requests\n", pc.peer.String(), len(pc.pending))
+
+		expired = expired[:0]
+		for block := range pc.pending {
+			expired = append(expired, block)
+		}
+	}
+
+	for _, block := range expired {
+		delete(pc.pending, block)
+		pc.pieceManager.ReleaseBlock(pc.peer.String(), block)
+	}
+	pc.pendingMu.Unlock()
+
+	for _, block := range expired {
+		pc.sendCancel(block)
+	}
+
+	if len(expired) > 0 {
+		pc.FillPipeline()
+	}
+}
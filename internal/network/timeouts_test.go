@@ -0,0 +1,162 @@
+package network
+
+import (
+	"encoding/binary"
+	"gotor/internal/storage"
+	"gotor/internal/testutil"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// newRequestingConnection returns an unchoked connection to a peer with
+// every piece, its pipeline already filled
+func newRequestingConnection(t *testing.T) (*PeerConnection, <-chan []byte) {
+	t.Helper()
+
+	ti := testutil.NewTorrentInfo(t, 40000, 16384, false)
+	pc := NewPeerConnection(NewPeer(netip.MustParseAddrPort("192.0.2.1:6881")), ti, "peer", nil, storage.NewPieceManager(ti), nil)
+	messages := pipeMessages(t, pc)
+	pc.established.Store(true)
+	t.Cleanup(func() { pc.Stop() })
+	go pc.runWriter()
+
+	if err := pc.handleBitfield([]byte{0xe0}); err != nil {
+		t.Fatal(err)
+	}
+	pc.peerChoking.Store(false)
+	pc.FillPipeline()
+
+	// the whole torrent is 3 blocks
+	for range 3 {
+		if msg := nextMessage(t, messages); MessageID(msg[0]) != MsgRequest {
+			t.Fatalf("sent message %d, want a request", msg[0])
+		}
+	}
+
+	return pc, messages
+}
+
+// countMessages reads n messages and counts them by id
+func countMessages(t *testing.T, messages <-chan []byte, n int) map[MessageID]int {
+	t.Helper()
+
+	counts := make(map[MessageID]int)
+	for range n {
+		counts[MessageID(nextMessage(t, messages)[0])]++
+	}
+	return counts
+}
+
+func TestExpireRequestsCancelsLateRequests(t *testing.T) {
+	pc, messages := newRequestingConnection(t)
+	pc.lastBlock.Store(time.Now().UnixNano())
+
+	late := storage.Block{Index: 1, Begin: 0, Length: 16384}
+	pc.pendingMu.Lock()
+	if _, ok := pc.pending[late]; !ok {
+		t.Fatalf("block %+v was not requested", late)
+	}
+	pc.pending[late] = time.Now().Add(-requestTimeout)
+	pc.pendingMu.Unlock()
+
+	pc.checkTimers()
+
+	// the late block is cancelled and the room refilled
+	counts := countMessages(t, messages, 2)
+	if counts[MsgCancel] != 1 || counts[MsgRequest] != 1 {
+		t.Errorf("sent %v, want one cancel and one request", counts)
+	}
+	if pc.snubbed.Load() {
+		t.Error("peer that delivers blocks counted as snubbing")
+	}
+
+	pc.pendingMu.Lock()
+	pending := len(pc.pending)
+	pc.pendingMu.Unlock()
+	if pending != 3 {
+		t.Errorf("%d requests outstanding, want 3", pending)
+	}
+}
+
+func TestSnubWithdrawsRequestsAndKeepsOne(t *testing.T) {
+	pc, messages := newRequestingConnection(t)
+
+	// nothing arrived since the requests went out a while ago
+	pc.pendingMu.Lock()
+	for block := range pc.pending {
+		pc.pending[block] = time.Now().Add(-pc.snubTimeout)
+	}
+	pc.pendingMu.Unlock()
+
+	pc.checkTimers()
+
+	if !pc.snubbed.Load() {
+		t.Fatal("peer not marked as snubbing")
+	}
+	counts := countMessages(t, messages, 4)
+	if counts[MsgCancel] != 3 || counts[MsgRequest] != 1 {
+		t.Errorf("sent %v, want 3 cancels and one request", counts)
+	}
+
+	pc.pendingMu.Lock()
+	pending := len(pc.pending)
+	pc.pendingMu.Unlock()
+	if pending != 1 {
+		t.Errorf("%d requests outstanding while snubbed, want 1", pending)
+	}
+
+	// the pipeline stays at one request until the peer delivers
+	pc.FillPipeline()
+	select {
+	case msg := <-messages:
+		t.Errorf("sent message %d while snubbed", msg[0])
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	ti := testutil.NewTorrentInfo(t, 40000, 16384, false)
+	pc := NewPeerConnection(NewPeer(netip.MustParseAddrPort("192.0.2.1:6881")), ti, "peer", nil, nil, nil)
+
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	pc.conn = local
+
+	// something was sent recently, no keep-alive is due
+	pc.lastWrite.Store(time.Now().UnixNano())
+	go pc.checkTimers()
+	remote.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := remote.Read(make([]byte, 4)); err == nil {
+		t.Fatal("sent a keep-alive right after another message")
+	}
+
+	pc.lastWrite.Store(time.Now().Add(-keepAliveInterval).UnixNano())
+	go pc.checkTimers()
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var length uint32
+	if err := binary.Read(remote, binary.BigEndian, &length); err != nil {
+		t.Fatal(err)
+	}
+	if length != 0 {
+		t.Fatalf("sent a message of length %d, want a keep-alive", length)
+	}
+
+	// the next one is two minutes away again
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Since(time.Unix(0, pc.lastWrite.Load())) >= keepAliveInterval {
+		if time.Now().After(deadline) {
+			t.Fatal("keep-alive did not count as a write")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	remote.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _ := io.ReadFull(remote, make([]byte, 1)); n != 0 {
+		t.Error("sent more than one keep-alive")
+	}
+}
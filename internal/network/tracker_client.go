@@ -1,30 +1,139 @@
 package network
 
 import (
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"gotor/internal/torrent"
+	"gotor/internal/trackerproto"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
+type AnnounceParams struct {
+	InfoHash   [20]byte
+	PeerId     string
+	Port       int
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      trackerproto.Event
+	// -1 lets the tracker decide
+	NumWant   int
+	TrackerId string
+}
+
+type AnnounceResponse struct {
+	Interval    time.Duration
+	MinInterval time.Duration
+	TrackerId   string
+	Seeders     int
+	Leechers    int
+	Peers       []Peer
+}
+
+type ScrapeResult struct {
+	Seeders   int
+	Completed int
+	Leechers  int
+}
+
+// ErrScrapeNotSupported is returned for HTTP trackers whose announce url
+// has no scrape counterpart
+var ErrScrapeNotSupported = errors.New("tracker does not support scrape")
+
+// Tracker is implemented by the HTTP and UDP tracker clients
+type Tracker interface {
+	Announce(announceUrl string, params AnnounceParams) (*AnnounceResponse, error)
+	// Scrape returns the swarm counters of every requested info hash the
+	// tracker knows about
+	Scrape(announceUrl string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error)
+}
+
+// NewTracker returns a client speaking the protocol of the announce url
+func NewTracker(announceUrl string) (Tracker, error) {
+	u, err := url.Parse(announceUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return NewTrackerClient(), nil
+	case "udp":
+		return NewUDPTrackerClient(), nil
+	default:
+		return nil, fmt.Errorf("unsupported tracker protocol: %s", u.Scheme)
+	}
+}
+
+// the body of a tracker response is never anywhere near this big
+const maxTrackerResponseSize = 4 * 1024 * 1024
+
+type TrackerClientConfig struct {
+	// Timeout bounds a whole request including redirects and reading the body
+	Timeout time.Duration
+	// InsecureSkipVerify accepts any certificate from HTTPS trackers
+	InsecureSkipVerify bool
+	// MaxRedirects is the number of redirects followed, 0 disables them
+	MaxRedirects int
+}
+
+func DefaultTrackerClientConfig() TrackerClientConfig {
+	return TrackerClientConfig{
+		Timeout:      30 * time.Second,
+		MaxRedirects: 5,
+	}
+}
+
+// TrackerClient talks to HTTP and HTTPS trackers
 type TrackerClient struct {
+	client *http.Client
 }
 
 func NewTrackerClient() *TrackerClient {
-	return &TrackerClient{}
+	return NewTrackerClientWithConfig(DefaultTrackerClientConfig())
 }
 
-func (tc *TrackerClient) Request(host string, path string, port int) (string, error) {
-	url := fmt.Sprintf("http://%s:%d%s", host, port, path)
+func NewTrackerClientWithConfig(config TrackerClientConfig) *TrackerClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
 
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", url, nil)
+	return &TrackerClient{
+		client: &http.Client{
+			Timeout:   config.Timeout,
+			Transport: transport,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > config.MaxRedirects {
+					return fmt.Errorf("stopped after %d redirects", config.MaxRedirects)
+				}
+				// a passkey must not leak over plain http
+				if via[0].URL.Scheme == "https" && req.URL.Scheme != "https" {
+					return errors.New("refusing redirect from https to http")
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// Request performs a GET on the full tracker url and returns the body
+func (tc *TrackerClient) Request(trackerUrl string) (string, error) {
+	req, err := http.NewRequest("GET", trackerUrl, nil)
+	if err != nil {
+		return "", err
+	}
 	req.Header.Set("User-Agent", "Transmission/3.00")
-	resp, err := client.Do(req)
+
+	resp, err := tc.client.Do(req)
 	if err != nil {
 		log.Printf("http get error: %v", err)
 		return "", err
@@ -35,53 +144,253 @@ func (tc *TrackerClient) Request(host string, path string, port int) (string, er
 		return "", fmt.Errorf("http status: %v", resp.StatusCode)
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTrackerResponseSize))
 	return string(body), err
 }
 
-func (tc *TrackerClient) ExtractPeers(bencodeResponse string) ([]Peer, error) {
-	buffer := make([]byte, len(bencodeResponse))
-	copy(buffer, []byte(bencodeResponse))
-	parser, err := torrent.NewParserFromData(buffer)
+// withQuery appends parameters to a tracker url, keeping the query it
+// already has such as a passkey untouched
+func withQuery(trackerUrl string, query url.Values) (string, error) {
+	u, err := url.Parse(trackerUrl)
+	if err != nil {
+		return "", fmt.Errorf("error parsing tracker url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("not an http tracker: %s", trackerUrl)
+	}
+
+	if u.RawQuery != "" {
+		u.RawQuery += "&"
+	}
+	u.RawQuery += query.Encode()
+	u.Fragment = ""
+
+	return u.String(), nil
+}
+
+func (tc *TrackerClient) Announce(announceUrl string, params AnnounceParams) (*AnnounceResponse, error) {
+	query := url.Values{}
+	query.Add("info_hash", string(params.InfoHash[:]))
+	query.Add("peer_id", params.PeerId)
+	query.Add("port", strconv.Itoa(params.Port))
+	query.Add("uploaded", strconv.FormatInt(params.Uploaded, 10))
+	query.Add("downloaded", strconv.FormatInt(params.Downloaded, 10))
+	query.Add("left", strconv.FormatInt(params.Left, 10))
+	query.Add("compact", "1")
+	if params.Event != trackerproto.EventNone {
+		query.Add("event", params.Event.String())
+	}
+	if params.NumWant >= 0 {
+		query.Add("numwant", strconv.Itoa(params.NumWant))
+	}
+	if params.TrackerId != "" {
+		query.Add("trackerid", params.TrackerId)
+	}
+
+	requestUrl, err := withQuery(announceUrl, query)
+	if err != nil {
+		return nil, err
+	}
+
+	rawResponse, err := tc.Request(requestUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := parseTrackerResponse(rawResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	dict := root.AsDict()
+
+	peers, err := extractPeers(dict)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AnnounceResponse{
+		Interval:    time.Duration(dict["interval"].AsInt()) * time.Second,
+		MinInterval: time.Duration(dict["min interval"].AsInt()) * time.Second,
+		TrackerId:   dict["tracker id"].AsString(),
+		Seeders:     dict["complete"].AsInt(),
+		Leechers:    dict["incomplete"].AsInt(),
+		Peers:       peers,
+	}, nil
+}
+
+// ScrapeUrl derives the scrape url of an HTTP tracker by replacing
+// "announce" at the start of the last path element with "scrape"
+func ScrapeUrl(announceUrl string) (string, error) {
+	u, err := url.Parse(announceUrl)
+	if err != nil {
+		return "", err
+	}
+
+	slash := strings.LastIndex(u.Path, "/")
+	if slash == -1 || !strings.HasPrefix(u.Path[slash+1:], "announce") {
+		return "", ErrScrapeNotSupported
+	}
+
+	u.Path = u.Path[:slash+1] + "scrape" + strings.TrimPrefix(u.Path[slash+1:], "announce")
+	u.RawPath = ""
+
+	return u.String(), nil
+}
+
+func (tc *TrackerClient) Scrape(announceUrl string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	if len(infoHashes) == 0 {
+		return nil, errors.New("no info hashes to scrape")
+	}
+
+	scrapeUrl, err := ScrapeUrl(announceUrl)
 	if err != nil {
-		log.Printf("NewParserFromData error: %v", err)
 		return nil, err
 	}
 
+	query := url.Values{}
+	for _, hash := range infoHashes {
+		query.Add("info_hash", string(hash[:]))
+	}
+
+	requestUrl, err := withQuery(scrapeUrl, query)
+	if err != nil {
+		return nil, err
+	}
+
+	rawResponse, err := tc.Request(requestUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := parseTrackerResponse(rawResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	files := root.AsDict()["files"].AsDict()
+	if files == nil {
+		return nil, errors.New("no files in scrape response")
+	}
+
+	results := make(map[[20]byte]ScrapeResult, len(files))
+	for key, node := range files {
+		if len(key) != 20 {
+			continue
+		}
+
+		stats := node.AsDict()
+		results[[20]byte([]byte(key))] = ScrapeResult{
+			Seeders:   stats["complete"].AsInt(),
+			Completed: stats["downloaded"].AsInt(),
+			Leechers:  stats["incomplete"].AsInt(),
+		}
+	}
+
+	return results, nil
+}
+
+// parseTrackerResponse decodes a bencoded tracker reply and turns a
+// failure reason into an error
+func parseTrackerResponse(bencodeResponse string) (torrent.Node, error) {
+	parser, err := torrent.NewParserFromData([]byte(bencodeResponse))
+	if err != nil {
+		log.Printf("NewParserFromData error: %v", err)
+		return torrent.Node{}, err
+	}
+
 	root, err := parser.Parse()
 	if err != nil {
 		log.Printf("parse error: %v\n", err)
-		return nil, err
+		return torrent.Node{}, err
 	}
 
 	dict := root.AsDict()
+	if dict == nil {
+		return torrent.Node{}, errors.New("tracker response is not a dictionary")
+	}
 
 	if _, ok := dict["failure reason"]; ok {
-		return nil, fmt.Errorf("tracker reported error: %s", dict["failure reason"].AsString())
+		return torrent.Node{}, fmt.Errorf("tracker reported error: %s", dict["failure reason"].AsString())
 	}
 
-	if _, ok := dict["peers"]; !ok {
+	return root, nil
+}
+
+func (tc *TrackerClient) ExtractPeers(bencodeResponse string) ([]Peer, error) {
+	root, err := parseTrackerResponse(bencodeResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	return extractPeers(root.AsDict())
+}
+
+// extractPeers reads the peers of an announce response. "peers" is either
+// the compact string of BEP 23 or the original list of dictionaries, IPv6
+// peers come compact in "peers6" (BEP 7)
+func extractPeers(dict map[string]torrent.Node) ([]Peer, error) {
+	peersNode, hasPeers := dict["peers"]
+	peers6Node, hasPeers6 := dict["peers6"]
+	if !hasPeers && !hasPeers6 {
 		return nil, errors.New("no peers found in dict")
 	}
 
-	blob := dict["peers"].AsString()
-	if len(blob)%6 != 0 {
-		log.Println("Warning: peers blob length is not dividable by 6")
+	var peers []Peer
+	switch value := peersNode.Value.(type) {
+	case string:
+		peers = parseCompactPeers([]byte(value), net.IPv4len)
+	case []torrent.Node:
+		peers = parseDictPeers(value)
 	}
 
-	numPeers := len(blob) / 6
+	peers = append(peers, parseCompactPeers([]byte(peers6Node.AsString()), net.IPv6len)...)
+
+	return peers, nil
+}
+
+// parseDictPeers decodes the non-compact peer list, entries whose ip is not
+// a literal address are skipped
+func parseDictPeers(list []torrent.Node) []Peer {
+	peers := make([]Peer, 0, len(list))
+	for _, node := range list {
+		dict := node.AsDict()
+
+		ip, err := netip.ParseAddr(dict["ip"].AsString())
+		if err != nil {
+			log.Printf("Skipping tracker peer %q: %v\n", dict["ip"].AsString(), err)
+			continue
+		}
+
+		port := dict["port"].AsInt()
+		if port <= 0 || port > 65535 {
+			continue
+		}
+
+		peers = append(peers, NewPeer(netip.AddrPortFrom(ip, uint16(port))))
+	}
+
+	return peers
+}
+
+// parseCompactPeers decodes ip:port entries packed back to back, 6 bytes each
+// for IPv4 and 18 for IPv6
+func parseCompactPeers(blob []byte, ipLen int) []Peer {
+	entryLen := ipLen + 2
+	if len(blob)%entryLen != 0 {
+		log.Printf("Warning: peers blob length is not dividable by %d\n", entryLen)
+	}
+
+	numPeers := len(blob) / entryLen
 	peers := make([]Peer, 0, numPeers)
 	for i := 0; i < numPeers; i++ {
-		offset := i * 6
+		offset := i * entryLen
 
-		ip := net.IP(blob[offset : offset+4])
-		port := binary.BigEndian.Uint16([]byte(blob[offset+4 : offset+6]))
+		ip, _ := netip.AddrFromSlice(blob[offset : offset+ipLen])
+		port := binary.BigEndian.Uint16(blob[offset+ipLen : offset+entryLen])
 
-		peers = append(peers, Peer{
-			ip:   ip.String(),
-			port: port,
-		})
+		peers = append(peers, NewPeer(netip.AddrPortFrom(ip, port)))
 	}
 
-	return peers, nil
+	return peers
 }
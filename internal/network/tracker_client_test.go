@@ -0,0 +1,137 @@
+package network
+
+import (
+	"errors"
+	"gotor/internal/torrent"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestScrapeUrl(t *testing.T) {
+	tests := []struct {
+		announce string
+		scrape   string
+	}{
+		{"http://example.com/announce", "http://example.com/scrape"},
+		{"http://example.com/x/announce", "http://example.com/x/scrape"},
+		{"http://example.com/announce.php", "http://example.com/scrape.php"},
+		{"https://example.com/announce?passkey=abc", "https://example.com/scrape?passkey=abc"},
+		{"http://example.com/tracker/announce.php?passkey=abc&uid=1", "http://example.com/tracker/scrape.php?passkey=abc&uid=1"},
+	}
+
+	for _, tt := range tests {
+		got, err := ScrapeUrl(tt.announce)
+		if err != nil {
+			t.Errorf("%s: %v", tt.announce, err)
+			continue
+		}
+		if got != tt.scrape {
+			t.Errorf("%s: got %s, want %s", tt.announce, got, tt.scrape)
+		}
+	}
+}
+
+func TestScrapeUrlNotSupported(t *testing.T) {
+	for _, announce := range []string{
+		"http://example.com/a",
+		"http://example.com/announce/x",
+		"http://example.com/xannounce",
+		"http://example.com",
+	} {
+		if _, err := ScrapeUrl(announce); !errors.Is(err, ErrScrapeNotSupported) {
+			t.Errorf("%s: got %v", announce, err)
+		}
+	}
+}
+
+func TestScrapeMultipleHashes(t *testing.T) {
+	first := [20]byte{1}
+	second := [20]byte{2}
+	unknown := [20]byte{3}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape.php" {
+			t.Errorf("requested %s", r.URL.Path)
+		}
+		if passkey := r.URL.Query().Get("passkey"); passkey != "abc" {
+			t.Errorf("passkey %q", passkey)
+		}
+		if hashes := r.URL.Query()["info_hash"]; len(hashes) != 3 {
+			t.Errorf("got %d info hashes", len(hashes))
+		}
+
+		stats := func(complete, downloaded, incomplete int) torrent.Node {
+			return torrent.Node{Value: map[string]torrent.Node{
+				"complete":   {Value: complete},
+				"downloaded": {Value: downloaded},
+				"incomplete": {Value: incomplete},
+			}}
+		}
+		body, err := torrent.Encode(torrent.Node{Value: map[string]torrent.Node{
+			"files": {Value: map[string]torrent.Node{
+				string(first[:]):  stats(5, 10, 1),
+				string(second[:]): stats(0, 2, 7),
+				// not a valid info hash, skipped
+				"short": stats(1, 1, 1),
+			}},
+		}})
+		if err != nil {
+			t.Error(err)
+		}
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	results, err := NewTrackerClient().Scrape(server.URL+"/announce.php?passkey=abc", [][20]byte{first, second, unknown})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 {
+		t.Errorf("got %d results, want 2", len(results))
+	}
+	if got := results[first]; got != (ScrapeResult{Seeders: 5, Completed: 10, Leechers: 1}) {
+		t.Errorf("first: got %+v", got)
+	}
+	if got := results[second]; got != (ScrapeResult{Seeders: 0, Completed: 2, Leechers: 7}) {
+		t.Errorf("second: got %+v", got)
+	}
+}
+
+func TestScrapeFailureReason(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason9:not founde"))
+	}))
+	defer server.Close()
+
+	_, err := NewTrackerClient().Scrape(server.URL+"/announce", [][20]byte{{1}})
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestTrackerManagerScrapeFallsBack(t *testing.T) {
+	hash := [20]byte{1}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := torrent.Encode(torrent.Node{Value: map[string]torrent.Node{
+			"files": {Value: map[string]torrent.Node{
+				string(hash[:]): {Value: map[string]torrent.Node{"complete": {Value: 4}}},
+			}},
+		}})
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	// the first tier cannot be scraped at all
+	tm := NewTrackerManager([][]string{{server.URL + "/tracker"}, {server.URL + "/announce"}})
+	results, err := tm.Scrape([][20]byte{hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[hash].Seeders != 4 {
+		t.Errorf("got %+v", results[hash])
+	}
+}
@@ -0,0 +1,260 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"slices"
+	"sync"
+)
+
+// TrackerManager announces to the trackers of a torrent as described in
+// BEP 12. Trackers of a tier are tried in random order, one that answers is
+// moved to the front of its tier and the next tier is only used once every
+// tracker of the previous one failed. With Parallel set all tiers are
+// announced to at once and their peers are merged
+type TrackerManager struct {
+	sync.Mutex
+	Parallel bool
+	// HTTPConfig applies to HTTP and HTTPS trackers, set it before announcing
+	HTTPConfig TrackerClientConfig
+	// UDPMaxRetransmits applies to UDP trackers, set it before announcing
+	UDPMaxRetransmits int
+	tiers             [][]string
+	clients           map[string]Tracker
+	// tracker ids handed out by trackers, sent back on later announces
+	trackerIds map[string]string
+}
+
+func NewTrackerManager(tiers [][]string) *TrackerManager {
+	tm := &TrackerManager{
+		HTTPConfig:        DefaultTrackerClientConfig(),
+		UDPMaxRetransmits: DefaultUDPMaxRetransmits,
+		clients:           make(map[string]Tracker),
+		trackerIds:        make(map[string]string),
+	}
+
+	for _, tier := range tiers {
+		if len(tier) == 0 {
+			continue
+		}
+
+		shuffled := append([]string(nil), tier...)
+		rand.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		tm.tiers = append(tm.tiers, shuffled)
+	}
+
+	return tm
+}
+
+// Empty reports whether there is no tracker to announce to
+func (tm *TrackerManager) Empty() bool {
+	tm.Lock()
+	defer tm.Unlock()
+
+	return len(tm.tiers) == 0
+}
+
+func (tm *TrackerManager) Announce(params AnnounceParams) (*AnnounceResponse, error) {
+	if tm.Empty() {
+		return nil, errors.New("no trackers")
+	}
+
+	if tm.Parallel {
+		return tm.announceAll(params)
+	}
+
+	var errs []error
+	for tier := range tm.tierCount() {
+		resp, err := tm.announceTier(tier, params)
+		if err == nil {
+			return resp, nil
+		}
+		errs = append(errs, err)
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+func (tm *TrackerManager) announceAll(params AnnounceParams) (*AnnounceResponse, error) {
+	count := tm.tierCount()
+	responses := make([]*AnnounceResponse, count)
+	errs := make([]error, count)
+
+	var wg sync.WaitGroup
+	for tier := range count {
+		wg.Add(1)
+		go func(tier int) {
+			defer wg.Done()
+			responses[tier], errs[tier] = tm.announceTier(tier, params)
+		}(tier)
+	}
+	wg.Wait()
+
+	// the first tier that answered gives the interval and counters, the
+	// peers of every tier are merged
+	var merged *AnnounceResponse
+	seen := make(map[string]struct{})
+	for _, resp := range responses {
+		if resp == nil {
+			continue
+		}
+
+		if merged == nil {
+			merged = &AnnounceResponse{
+				Interval:    resp.Interval,
+				MinInterval: resp.MinInterval,
+				TrackerId:   resp.TrackerId,
+				Seeders:     resp.Seeders,
+				Leechers:    resp.Leechers,
+			}
+		}
+
+		for _, peer := range resp.Peers {
+			if _, ok := seen[peer.String()]; ok {
+				continue
+			}
+			seen[peer.String()] = struct{}{}
+			merged.Peers = append(merged.Peers, peer)
+		}
+	}
+
+	if merged == nil {
+		return nil, errors.Join(errs...)
+	}
+
+	return merged, nil
+}
+
+// Scrape asks the trackers in tier order until one answers
+func (tm *TrackerManager) Scrape(infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	tm.Lock()
+	var urls []string
+	for _, tier := range tm.tiers {
+		urls = append(urls, tier...)
+	}
+	tm.Unlock()
+
+	if len(urls) == 0 {
+		return nil, errors.New("no trackers")
+	}
+
+	var errs []error
+	for _, announceUrl := range urls {
+		tracker, err := tm.client(announceUrl)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		results, err := tracker.Scrape(announceUrl, infoHashes)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", announceUrl, err))
+			continue
+		}
+
+		return results, nil
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// announceTier tries the trackers of one tier in order until one answers
+func (tm *TrackerManager) announceTier(tier int, params AnnounceParams) (*AnnounceResponse, error) {
+	tm.Lock()
+	urls := append([]string(nil), tm.tiers[tier]...)
+	tm.Unlock()
+
+	var errs []error
+	for _, announceUrl := range urls {
+		tracker, err := tm.client(announceUrl)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		tm.Lock()
+		params.TrackerId = tm.trackerIds[announceUrl]
+		tm.Unlock()
+
+		resp, err := tracker.Announce(announceUrl, params)
+		if err != nil {
+			log.Printf("Tracker %s: %v\n", announceUrl, err)
+			errs = append(errs, fmt.Errorf("%s: %w", announceUrl, err))
+			continue
+		}
+
+		tm.promote(tier, announceUrl)
+		if resp.TrackerId != "" {
+			tm.Lock()
+			tm.trackerIds[announceUrl] = resp.TrackerId
+			tm.Unlock()
+		}
+
+		return resp, nil
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// promote moves a tracker that answered to the front of its tier
+func (tm *TrackerManager) promote(tier int, announceUrl string) {
+	tm.Lock()
+	defer tm.Unlock()
+
+	urls := tm.tiers[tier]
+	i := slices.Index(urls, announceUrl)
+	if i <= 0 {
+		return
+	}
+
+	copy(urls[1:i+1], urls[:i])
+	urls[0] = announceUrl
+}
+
+func (tm *TrackerManager) tierCount() int {
+	tm.Lock()
+	defer tm.Unlock()
+
+	return len(tm.tiers)
+}
+
+// client returns one client per protocol so the UDP connection ids are
+// shared between trackers and announces
+func (tm *TrackerManager) client(announceUrl string) (Tracker, error) {
+	u, err := url.Parse(announceUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := u.Scheme
+	if scheme == "https" {
+		scheme = "http"
+	}
+
+	tm.Lock()
+	defer tm.Unlock()
+
+	if tracker, ok := tm.clients[scheme]; ok {
+		return tracker, nil
+	}
+
+	var tracker Tracker
+	switch scheme {
+	case "http":
+		tracker = NewTrackerClientWithConfig(tm.HTTPConfig)
+	case "udp":
+		udp := NewUDPTrackerClient()
+		udp.MaxRetransmits = tm.UDPMaxRetransmits
+		tracker = udp
+	default:
+		return nil, fmt.Errorf("unsupported tracker protocol: %s", u.Scheme)
+	}
+	tm.clients[scheme] = tracker
+
+	return tracker, nil
+}
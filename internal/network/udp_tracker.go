@@ -0,0 +1,278 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gotor/internal/trackerproto"
+	"math/rand"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// a connection id may be used for one minute after it was received
+const udpConnectionIdLifetime = time.Minute
+
+// BEP 15 retransmits a request up to 8 times, the last wait alone is over an
+// hour
+const DefaultUDPMaxRetransmits = 8
+
+type udpConnectionId struct {
+	id       uint64
+	obtained time.Time
+}
+
+// UDPTrackerClient speaks the UDP tracker protocol (BEP 15). Connection ids
+// are cached per tracker address and requests are retransmitted after
+// BaseTimeout * 2^n for n up to MaxRetransmits. Lowering MaxRetransmits
+// moves on to the next tracker sooner when one is down
+type UDPTrackerClient struct {
+	sync.Mutex
+	BaseTimeout    time.Duration
+	MaxRetransmits int
+	connectionIds  map[string]udpConnectionId
+	key            uint32
+}
+
+func NewUDPTrackerClient() *UDPTrackerClient {
+	return &UDPTrackerClient{
+		BaseTimeout:    15 * time.Second,
+		MaxRetransmits: DefaultUDPMaxRetransmits,
+		connectionIds:  make(map[string]udpConnectionId),
+		key:            rand.Uint32(),
+	}
+}
+
+func (uc *UDPTrackerClient) Announce(announceUrl string, params AnnounceParams) (*AnnounceResponse, error) {
+	conn, err := uc.dial(announceUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	numWant := int32(params.NumWant)
+	if params.NumWant < 0 {
+		numWant = -1
+	}
+
+	build := func(connectionId uint64, transactionId uint32) []byte {
+		req := make([]byte, 98)
+		binary.BigEndian.PutUint64(req[0:8], connectionId)
+		binary.BigEndian.PutUint32(req[8:12], trackerproto.UDPActionAnnounce)
+		binary.BigEndian.PutUint32(req[12:16], transactionId)
+		copy(req[16:36], params.InfoHash[:])
+		copy(req[36:56], params.PeerId)
+		binary.BigEndian.PutUint64(req[56:64], uint64(params.Downloaded))
+		binary.BigEndian.PutUint64(req[64:72], uint64(params.Left))
+		binary.BigEndian.PutUint64(req[72:80], uint64(params.Uploaded))
+		binary.BigEndian.PutUint32(req[80:84], uint32(params.Event))
+		// ip 0 means the sender address
+		binary.BigEndian.PutUint32(req[84:88], 0)
+		binary.BigEndian.PutUint32(req[88:92], uc.key)
+		binary.BigEndian.PutUint32(req[92:96], uint32(numWant))
+		binary.BigEndian.PutUint16(req[96:98], uint16(params.Port))
+		return req
+	}
+
+	resp, err := uc.request(conn, trackerproto.UDPActionAnnounce, build)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 20 {
+		return nil, fmt.Errorf("announce response too short: %d bytes", len(resp))
+	}
+
+	// the peer list matches the address family we talk to the tracker over
+	ipLen := net.IPv4len
+	if conn.RemoteAddr().(*net.UDPAddr).IP.To4() == nil {
+		ipLen = net.IPv6len
+	}
+
+	return &AnnounceResponse{
+		Interval: time.Duration(binary.BigEndian.Uint32(resp[8:12])) * time.Second,
+		Leechers: int(binary.BigEndian.Uint32(resp[12:16])),
+		Seeders:  int(binary.BigEndian.Uint32(resp[16:20])),
+		Peers:    parseCompactPeers(resp[20:], ipLen),
+	}, nil
+}
+
+func (uc *UDPTrackerClient) Scrape(announceUrl string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	if len(infoHashes) == 0 || len(infoHashes) > trackerproto.MaxScrapeHashes {
+		return nil, fmt.Errorf("can scrape between 1 and %d info hashes, got %d", trackerproto.MaxScrapeHashes, len(infoHashes))
+	}
+
+	conn, err := uc.dial(announceUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	build := func(connectionId uint64, transactionId uint32) []byte {
+		req := make([]byte, 16+20*len(infoHashes))
+		binary.BigEndian.PutUint64(req[0:8], connectionId)
+		binary.BigEndian.PutUint32(req[8:12], trackerproto.UDPActionScrape)
+		binary.BigEndian.PutUint32(req[12:16], transactionId)
+		for i, hash := range infoHashes {
+			copy(req[16+20*i:], hash[:])
+		}
+		return req
+	}
+
+	resp, err := uc.request(conn, trackerproto.UDPActionScrape, build)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 8+12*len(infoHashes) {
+		return nil, fmt.Errorf("scrape response too short: %d bytes", len(resp))
+	}
+
+	results := make(map[[20]byte]ScrapeResult, len(infoHashes))
+	for i, hash := range infoHashes {
+		offset := 8 + 12*i
+		results[hash] = ScrapeResult{
+			Seeders:   int(binary.BigEndian.Uint32(resp[offset : offset+4])),
+			Completed: int(binary.BigEndian.Uint32(resp[offset+4 : offset+8])),
+			Leechers:  int(binary.BigEndian.Uint32(resp[offset+8 : offset+12])),
+		}
+	}
+
+	return results, nil
+}
+
+func (uc *UDPTrackerClient) dial(announceUrl string) (*net.UDPConn, error) {
+	u, err := url.Parse(announceUrl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "udp" {
+		return nil, fmt.Errorf("not a udp tracker: %s", announceUrl)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	return net.DialUDP("udp", nil, addr)
+}
+
+// request sends a request built for the current connection id and waits for
+// the matching response, retransmitting with the BEP 15 backoff. A new
+// connection id is obtained whenever the cached one is missing or expired
+func (uc *UDPTrackerClient) request(conn *net.UDPConn, action uint32, build func(connectionId uint64, transactionId uint32) []byte) ([]byte, error) {
+	host := conn.RemoteAddr().String()
+
+	for n := 0; n <= uc.MaxRetransmits; n++ {
+		timeout := uc.BaseTimeout * time.Duration(1<<n)
+
+		connectionId, ok := uc.cachedConnectionId(host)
+		if !ok {
+			resp, err := uc.exchange(conn, trackerproto.UDPActionConnect, timeout, func(transactionId uint32) []byte {
+				req := make([]byte, 16)
+				binary.BigEndian.PutUint64(req[0:8], trackerproto.UDPProtocolId)
+				binary.BigEndian.PutUint32(req[8:12], trackerproto.UDPActionConnect)
+				binary.BigEndian.PutUint32(req[12:16], transactionId)
+				return req
+			})
+			if isTimeout(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(resp) < 16 {
+				return nil, fmt.Errorf("connect response too short: %d bytes", len(resp))
+			}
+
+			connectionId = binary.BigEndian.Uint64(resp[8:16])
+			uc.storeConnectionId(host, connectionId)
+		}
+
+		resp, err := uc.exchange(conn, action, timeout, func(transactionId uint32) []byte {
+			return build(connectionId, transactionId)
+		})
+		if isTimeout(err) {
+			continue
+		}
+		if err != nil {
+			// the tracker may have rejected an id it no longer knows
+			uc.dropConnectionId(host)
+			return nil, err
+		}
+
+		return resp, nil
+	}
+
+	return nil, errors.New("udp tracker did not respond")
+}
+
+// exchange performs a single send and waits for the response carrying the
+// same transaction id, stray packets are skipped
+func (uc *UDPTrackerClient) exchange(conn *net.UDPConn, action uint32, timeout time.Duration, build func(transactionId uint32) []byte) ([]byte, error) {
+	transactionId := rand.Uint32()
+	if _, err := conn.Write(build(transactionId)); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 64*1024)
+	for {
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != transactionId {
+			continue
+		}
+
+		gotAction := binary.BigEndian.Uint32(buf[0:4])
+		if gotAction == trackerproto.UDPActionError {
+			return nil, fmt.Errorf("tracker reported error: %s", string(buf[8:n]))
+		}
+		if gotAction != action {
+			return nil, fmt.Errorf("unexpected action %d, expected %d", gotAction, action)
+		}
+
+		resp := make([]byte, n)
+		copy(resp, buf[:n])
+		return resp, nil
+	}
+}
+
+func (uc *UDPTrackerClient) cachedConnectionId(host string) (uint64, bool) {
+	uc.Lock()
+	defer uc.Unlock()
+
+	cached, ok := uc.connectionIds[host]
+	if !ok || time.Since(cached.obtained) > udpConnectionIdLifetime {
+		delete(uc.connectionIds, host)
+		return 0, false
+	}
+
+	return cached.id, true
+}
+
+func (uc *UDPTrackerClient) storeConnectionId(host string, id uint64) {
+	uc.Lock()
+	defer uc.Unlock()
+
+	uc.connectionIds[host] = udpConnectionId{id: id, obtained: time.Now()}
+}
+
+func (uc *UDPTrackerClient) dropConnectionId(host string) {
+	uc.Lock()
+	defer uc.Unlock()
+
+	delete(uc.connectionIds, host)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,277 @@
+package network
+
+import (
+	"encoding/binary"
+	"gotor/internal/trackerproto"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeUDPTracker answers connect requests itself and hands announces and
+// scrapes to respond, which returns the datagrams to send back
+type fakeUDPTracker struct {
+	conn         *net.UDPConn
+	connectionId uint64
+	connects     atomic.Int32
+	respond      func(req []byte) [][]byte
+}
+
+const testConnectionId = 0x1122334455667788
+
+func newFakeUDPTracker(t *testing.T, respond func(req []byte) [][]byte) *fakeUDPTracker {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	ft := &fakeUDPTracker{conn: conn, connectionId: testConnectionId, respond: respond}
+	go ft.serve()
+
+	return ft
+}
+
+func (ft *fakeUDPTracker) url() string {
+	return "udp://" + ft.conn.LocalAddr().String() + "/announce"
+}
+
+func (ft *fakeUDPTracker) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := ft.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < 16 {
+			continue
+		}
+		req := append([]byte(nil), buf[:n]...)
+
+		var replies [][]byte
+		if binary.BigEndian.Uint32(req[8:12]) == trackerproto.UDPActionConnect {
+			if binary.BigEndian.Uint64(req[0:8]) != trackerproto.UDPProtocolId {
+				continue
+			}
+			ft.connects.Add(1)
+			resp := udpReply(trackerproto.UDPActionConnect, req, 8)
+			binary.BigEndian.PutUint64(resp[8:16], ft.connectionId)
+			replies = [][]byte{resp}
+		} else {
+			replies = ft.respond(req)
+		}
+
+		for _, reply := range replies {
+			ft.conn.WriteToUDP(reply, addr)
+		}
+	}
+}
+
+// udpReply starts a response to req with room for size more bytes
+func udpReply(action uint32, req []byte, size int) []byte {
+	resp := make([]byte, 8+size)
+	binary.BigEndian.PutUint32(resp[0:4], action)
+	copy(resp[4:8], req[12:16])
+	return resp
+}
+
+func newTestUDPTrackerClient() *UDPTrackerClient {
+	uc := NewUDPTrackerClient()
+	uc.BaseTimeout = 100 * time.Millisecond
+	uc.MaxRetransmits = 1
+	return uc
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+
+	ft := newFakeUDPTracker(t, func(req []byte) [][]byte {
+		if binary.BigEndian.Uint64(req[0:8]) != testConnectionId {
+			t.Errorf("announce carried connection id %x", req[0:8])
+		}
+		if [20]byte(req[16:36]) != infoHash {
+			t.Errorf("announce carried info hash %x", req[16:36])
+		}
+		if port := binary.BigEndian.Uint16(req[96:98]); port != 6881 {
+			t.Errorf("announce carried port %d", port)
+		}
+
+		// a stray datagram for another transaction comes first
+		stray := udpReply(trackerproto.UDPActionAnnounce, req, 12)
+		binary.BigEndian.PutUint32(stray[4:8], binary.BigEndian.Uint32(req[12:16])+1)
+
+		resp := udpReply(trackerproto.UDPActionAnnounce, req, 12+6)
+		binary.BigEndian.PutUint32(resp[8:12], 1800)
+		binary.BigEndian.PutUint32(resp[12:16], 2)
+		binary.BigEndian.PutUint32(resp[16:20], 3)
+		copy(resp[20:], []byte{10, 0, 0, 1, 0x1a, 0xe1})
+
+		return [][]byte{stray, resp}
+	})
+
+	uc := newTestUDPTrackerClient()
+	resp, err := uc.Announce(ft.url(), AnnounceParams{InfoHash: infoHash, PeerId: strings.Repeat("p", 20), Port: 6881, NumWant: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Interval != 30*time.Minute || resp.Leechers != 2 || resp.Seeders != 3 {
+		t.Errorf("got interval %s, %d leechers, %d seeders", resp.Interval, resp.Leechers, resp.Seeders)
+	}
+	want := NewPeer(netip.MustParseAddrPort("10.0.0.1:6881"))
+	if len(resp.Peers) != 1 || resp.Peers[0] != want {
+		t.Errorf("got peers %v, want %v", resp.Peers, want)
+	}
+}
+
+func TestUDPScrape(t *testing.T) {
+	first := [20]byte{1}
+	second := [20]byte{2}
+
+	ft := newFakeUDPTracker(t, func(req []byte) [][]byte {
+		if action := binary.BigEndian.Uint32(req[8:12]); action != trackerproto.UDPActionScrape {
+			t.Errorf("got action %d", action)
+		}
+		if len(req) != 16+2*20 {
+			t.Errorf("scrape of %d bytes", len(req))
+		}
+
+		resp := udpReply(trackerproto.UDPActionScrape, req, 2*12)
+		for i, stats := range [][3]uint32{{5, 10, 1}, {0, 2, 7}} {
+			for j, value := range stats {
+				binary.BigEndian.PutUint32(resp[8+12*i+4*j:], value)
+			}
+		}
+		return [][]byte{resp}
+	})
+
+	uc := newTestUDPTrackerClient()
+	results, err := uc.Scrape(ft.url(), [][20]byte{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := results[first]; got != (ScrapeResult{Seeders: 5, Completed: 10, Leechers: 1}) {
+		t.Errorf("first: got %+v", got)
+	}
+	if got := results[second]; got != (ScrapeResult{Seeders: 0, Completed: 2, Leechers: 7}) {
+		t.Errorf("second: got %+v", got)
+	}
+}
+
+func TestUDPScrapeRejectsTooManyHashes(t *testing.T) {
+	uc := newTestUDPTrackerClient()
+	if _, err := uc.Scrape("udp://127.0.0.1:1/announce", make([][20]byte, trackerproto.MaxScrapeHashes+1)); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestUDPExpiredConnectionId(t *testing.T) {
+	ft := newFakeUDPTracker(t, func(req []byte) [][]byte {
+		return [][]byte{udpReply(trackerproto.UDPActionAnnounce, req, 12)}
+	})
+
+	uc := newTestUDPTrackerClient()
+	params := AnnounceParams{PeerId: strings.Repeat("p", 20), NumWant: -1}
+
+	for range 2 {
+		if _, err := uc.Announce(ft.url(), params); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := ft.connects.Load(); got != 1 {
+		t.Fatalf("connected %d times, the id should be reused", got)
+	}
+
+	uc.Lock()
+	for host, cached := range uc.connectionIds {
+		cached.obtained = time.Now().Add(-udpConnectionIdLifetime - time.Second)
+		uc.connectionIds[host] = cached
+	}
+	uc.Unlock()
+
+	if _, err := uc.Announce(ft.url(), params); err != nil {
+		t.Fatal(err)
+	}
+	if got := ft.connects.Load(); got != 2 {
+		t.Errorf("connected %d times, an expired id should be replaced", got)
+	}
+}
+
+func TestUDPErrorAction(t *testing.T) {
+	ft := newFakeUDPTracker(t, func(req []byte) [][]byte {
+		resp := udpReply(trackerproto.UDPActionError, req, 0)
+		return [][]byte{append(resp, "torrent not registered"...)}
+	})
+
+	uc := newTestUDPTrackerClient()
+	_, err := uc.Announce(ft.url(), AnnounceParams{PeerId: strings.Repeat("p", 20)})
+	if err == nil || !strings.Contains(err.Error(), "torrent not registered") {
+		t.Fatalf("got %v", err)
+	}
+
+	// the id may be what the tracker rejected
+	if _, ok := uc.cachedConnectionId(ft.conn.LocalAddr().String()); ok {
+		t.Error("connection id kept after an error")
+	}
+}
+
+func TestUDPRetransmit(t *testing.T) {
+	var announces atomic.Int32
+	ft := newFakeUDPTracker(t, func(req []byte) [][]byte {
+		if announces.Add(1) == 1 {
+			return nil
+		}
+		return [][]byte{udpReply(trackerproto.UDPActionAnnounce, req, 12)}
+	})
+
+	uc := newTestUDPTrackerClient()
+	if _, err := uc.Announce(ft.url(), AnnounceParams{PeerId: strings.Repeat("p", 20)}); err != nil {
+		t.Fatal(err)
+	}
+	if got := announces.Load(); got != 2 {
+		t.Errorf("got %d announces, want 2", got)
+	}
+}
+
+func TestUDPTrackerGivesUp(t *testing.T) {
+	ft := newFakeUDPTracker(t, func(req []byte) [][]byte {
+		return nil
+	})
+
+	uc := newTestUDPTrackerClient()
+	start := time.Now()
+	if _, err := uc.Announce(ft.url(), AnnounceParams{PeerId: strings.Repeat("p", 20)}); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// 100ms and 200ms for the two attempts
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("gave up after %s", elapsed)
+	}
+}
+
+func TestUDPTrackerDefaultRetransmits(t *testing.T) {
+	uc := NewUDPTrackerClient()
+	if uc.BaseTimeout != 15*time.Second || uc.MaxRetransmits != 8 {
+		t.Errorf("timeout %s and %d retransmits, want BEP 15's 15s and 8", uc.BaseTimeout, uc.MaxRetransmits)
+	}
+}
+
+func TestTrackerManagerUDPRetransmits(t *testing.T) {
+	tm := NewTrackerManager([][]string{{"udp://tracker.example:6969"}})
+	tm.UDPMaxRetransmits = 2
+
+	client, err := tm.client("udp://tracker.example:6969")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := client.(*UDPTrackerClient).MaxRetransmits; got != 2 {
+		t.Errorf("%d retransmits, want 2", got)
+	}
+}
@@ -0,0 +1,195 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// the largest block we serve, bigger requests are from broken or hostile peers
+const maxRequestLength = 128 * 1024
+
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+func parseBlockRequest(payload []byte) (blockRequest, error) {
+	if len(payload) != 12 {
+		return blockRequest{}, fmt.Errorf("invalid request length: %d", len(payload))
+	}
+
+	return blockRequest{
+		index:  int(binary.BigEndian.Uint32(payload[0:4])),
+		begin:  int(binary.BigEndian.Uint32(payload[4:8])),
+		length: int(binary.BigEndian.Uint32(payload[8:12])),
+	}, nil
+}
+
+func (pc *PeerConnection) validateRequest(req blockRequest) error {
+	if req.index < 0 || req.index >= pc.torrentInfo.PieceCount() {
+		return fmt.Errorf("piece %d out of range", req.index)
+	}
+
+	if !pc.pieceManager.Has(req.index) {
+		return fmt.Errorf("piece %d is not available", req.index)
+	}
+
+	if req.length <= 0 || req.length > maxRequestLength {
+		return fmt.Errorf("invalid block length %d", req.length)
+	}
+
+	if req.begin < 0 || int64(req.begin+req.length) > pc.torrentInfo.PieceSize(req.index) {
+		return fmt.Errorf("block %d+%d exceeds piece %d", req.begin, req.length, req.index)
+	}
+
+	return nil
+}
+
+func (pc *PeerConnection) handleRequest(payload []byte) error {
+	req, err := parseBlockRequest(payload)
+	if err != nil {
+		return err
+	}
+
+	pc.uploadMu.Lock()
+	defer pc.uploadMu.Unlock()
+
+	if pc.amChoking {
+		// requests sent before our choke arrived, nothing to do
+		return nil
+	}
+
+	if err := pc.validateRequest(req); err != nil {
+		log.Printf("Peer %s: rejected request: %v\n", pc.peer.String(), err)
+		return nil
+	}
+
+	if len(pc.uploadQueue) >= maxPeerRequests {
+		return errors.New("peer exceeded request queue limit")
+	}
+
+	pc.uploadQueue = append(pc.uploadQueue, req)
+
+	select {
+	case pc.uploadSignal <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// setChoking changes whether we choke the peer. Choking drops every request
+// still queued, as the spec says the peer has to re-request after an unchoke
+func (pc *PeerConnection) setChoking(choke bool) error {
+	pc.uploadMu.Lock()
+	if pc.amChoking == choke {
+		pc.uploadMu.Unlock()
+		return nil
+	}
+	pc.amChoking = choke
+	if choke {
+		pc.uploadQueue = nil
+	}
+	pc.uploadMu.Unlock()
+
+	if choke {
+		return pc.sendMessage(MsgChoke, nil)
+	}
+	return pc.sendMessage(MsgUnchoke, nil)
+}
+
+func (pc *PeerConnection) isChoking() bool {
+	pc.uploadMu.Lock()
+	defer pc.uploadMu.Unlock()
+
+	return pc.amChoking
+}
+
+func (pc *PeerConnection) isPeerInterested() bool {
+	pc.uploadMu.Lock()
+	defer pc.uploadMu.Unlock()
+
+	return pc.peerInterested
+}
+
+func (pc *PeerConnection) handleCancel(payload []byte) error {
+	req, err := parseBlockRequest(payload)
+	if err != nil {
+		return err
+	}
+
+	pc.uploadMu.Lock()
+	defer pc.uploadMu.Unlock()
+
+	for i, queued := range pc.uploadQueue {
+		if queued == req {
+			pc.uploadQueue = append(pc.uploadQueue[:i], pc.uploadQueue[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (pc *PeerConnection) nextUpload() (blockRequest, bool) {
+	pc.uploadMu.Lock()
+	defer pc.uploadMu.Unlock()
+
+	if len(pc.uploadQueue) == 0 || pc.amChoking {
+		return blockRequest{}, false
+	}
+
+	req := pc.uploadQueue[0]
+	pc.uploadQueue = pc.uploadQueue[1:]
+
+	return req, true
+}
+
+// runUploader serves queued requests until the connection is stopped. It runs
+// apart from the message loop so disk reads never stall incoming messages
+func (pc *PeerConnection) runUploader() {
+	for {
+		select {
+		case <-pc.done:
+			return
+		case <-pc.uploadSignal:
+		}
+
+		for {
+			req, ok := pc.nextUpload()
+			if !ok {
+				break
+			}
+
+			if err := pc.sendBlock(req); err != nil {
+				log.Printf("Peer %s: upload failed: %v\n", pc.peer.String(), err)
+				pc.Stop()
+				return
+			}
+		}
+	}
+}
+
+func (pc *PeerConnection) sendBlock(req blockRequest) error {
+	globalOffset := int64(req.index)*pc.torrentInfo.PieceLength() + int64(req.begin)
+	data, err := pc.fileManager.Read(globalOffset, req.length)
+	if err != nil {
+		return err
+	}
+
+	payload := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(req.index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(req.begin))
+	copy(payload[8:], data)
+
+	if err := pc.sendMessage(MsgPiece, payload); err != nil {
+		return err
+	}
+
+	pc.pieceManager.AddUploadedBytes(uint64(len(data)))
+	pc.uploaded.Add(uint64(len(data)))
+	return nil
+}
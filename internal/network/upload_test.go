@@ -0,0 +1,40 @@
+package network
+
+import (
+	"gotor/internal/storage"
+	"gotor/internal/testutil"
+	"net/netip"
+	"testing"
+)
+
+func TestValidateRequestAtLastPiece(t *testing.T) {
+	// three pieces, the last one 1000 bytes long
+	ti := testutil.NewTorrentInfo(t, 2*32768+1000, 32768, false)
+	pm := storage.NewPieceManager(ti)
+	for i := range ti.PieceCount() {
+		pm.MarkAsCompleted(i)
+	}
+
+	pc := NewPeerConnection(NewPeer(netip.MustParseAddrPort("192.0.2.1:6881")), ti, "peer", nil, pm, nil)
+
+	tests := []struct {
+		req blockRequest
+		ok  bool
+	}{
+		{blockRequest{index: 1, begin: 16384, length: 16384}, true},
+		{blockRequest{index: 1, begin: 16385, length: 16384}, false},
+		{blockRequest{index: 2, begin: 0, length: 1000}, true},
+		{blockRequest{index: 2, begin: 0, length: 1001}, false},
+		{blockRequest{index: 2, begin: 999, length: 1}, true},
+		{blockRequest{index: 2, begin: 1000, length: 1}, false},
+		{blockRequest{index: 2, begin: 0, length: 16384}, false},
+		{blockRequest{index: 3, begin: 0, length: 1}, false},
+	}
+
+	for _, tt := range tests {
+		err := pc.validateRequest(tt.req)
+		if (err == nil) != tt.ok {
+			t.Errorf("%+v: got %v", tt.req, err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package network
+
+import (
+	"fmt"
+	"gotor/internal/torrent"
+	"log"
+)
+
+const UtMetadataName = "ut_metadata"
+
+const (
+	utMetadataRequest = 0
+	utMetadataData    = 1
+	utMetadataReject  = 2
+)
+
+const maxMetadataInFlight = 2
+
+type utMetadata struct {
+	pc       *PeerConnection
+	metadata *Metadata
+	inFlight int
+	// metadata_size from the peer's handshake
+	size int
+	// pieces the peer rejected, they are not asked for again
+	rejected map[int]bool
+}
+
+// NewUtMetadataExtension returns the BEP 9 extension backed by shared metadata,
+// fetching missing pieces and serving them once complete
+func NewUtMetadataExtension(metadata *Metadata) ExtensionFactory {
+	return func(pc *PeerConnection) ExtensionHandler {
+		return &utMetadata{pc: pc, metadata: metadata, rejected: make(map[int]bool)}
+	}
+}
+
+func (ut *utMetadata) ExtendHandshake(dict map[string]torrent.Node) {
+	if ut.metadata.Complete() {
+		dict["metadata_size"] = torrent.Node{Value: ut.metadata.Size()}
+	}
+}
+
+func (ut *utMetadata) OnHandshake(hs *ExtendedHandshake) error {
+	if _, ok := hs.M[UtMetadataName]; !ok || ut.metadata.Complete() {
+		return nil
+	}
+
+	ut.size = hs.MetadataSize
+	if err := ut.metadata.SetSize(ut.size); err != nil {
+		return err
+	}
+
+	ut.requestPieces()
+	return nil
+}
+
+func (ut *utMetadata) requestPieces() {
+	// the size is dropped when the assembled metadata fails to verify, offer
+	// the one this peer announced
+	if ut.metadata.Size() == 0 {
+		if err := ut.metadata.SetSize(ut.size); err != nil {
+			return
+		}
+	}
+
+	for ut.inFlight < maxMetadataInFlight {
+		index, ok := ut.metadata.NextRequest(ut.rejected)
+		if !ok {
+			return
+		}
+
+		msg := map[string]torrent.Node{
+			"msg_type": {Value: utMetadataRequest},
+			"piece":    {Value: index},
+		}
+		if err := ut.pc.SendExtension(UtMetadataName, msg, nil); err != nil {
+			ut.metadata.Reject(index)
+			return
+		}
+
+		ut.inFlight++
+	}
+}
+
+func (ut *utMetadata) HandleMessage(payload []byte) error {
+	parser, _ := torrent.NewParserFromData(payload)
+	root, n, err := parser.ParsePrefix()
+	if err != nil {
+		return fmt.Errorf("invalid ut_metadata message: %w", err)
+	}
+
+	dict := root.AsDict()
+	index := dict["piece"].AsInt()
+
+	switch dict["msg_type"].AsInt() {
+	case utMetadataRequest:
+		return ut.servePiece(index)
+	case utMetadataData:
+		ut.inFlight = max(0, ut.inFlight-1)
+
+		if err := ut.metadata.AddPiece(index, payload[n:]); err != nil {
+			log.Printf("Peer %s: %v\n", ut.pc.peer.String(), err)
+		}
+		if ut.metadata.Complete() {
+			log.Println("Metadata complete")
+			return nil
+		}
+
+		ut.requestPieces()
+	case utMetadataReject:
+		ut.inFlight = max(0, ut.inFlight-1)
+		if ut.metadata.Reject(index) {
+			ut.rejected[index] = true
+		}
+
+		ut.requestPieces()
+	}
+
+	return nil
+}
+
+func (ut *utMetadata) servePiece(index int) error {
+	data, ok := ut.metadata.Piece(index)
+	if !ok {
+		msg := map[string]torrent.Node{
+			"msg_type": {Value: utMetadataReject},
+			"piece":    {Value: index},
+		}
+		return ut.pc.SendExtension(UtMetadataName, msg, nil)
+	}
+
+	msg := map[string]torrent.Node{
+		"msg_type":   {Value: utMetadataData},
+		"piece":      {Value: index},
+		"total_size": {Value: ut.metadata.Size()},
+	}
+	return ut.pc.SendExtension(UtMetadataName, msg, data)
+}
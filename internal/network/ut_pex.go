@@ -0,0 +1,264 @@
+package network
+
+import (
+	"fmt"
+	"gotor/internal/torrent"
+	"log"
+	"net/netip"
+	"time"
+)
+
+const UtPexName = "ut_pex"
+
+// BEP 11 flags sent along with every added peer
+const (
+	pexPrefersEncryption = 0x01
+	pexSeed              = 0x02
+	pexSupportsUTP       = 0x04
+	pexHolepunch         = 0x08
+	pexReachable         = 0x10
+)
+
+const (
+	// how often we send a peer exchange message to each peer
+	pexInterval = time.Minute
+	// messages arriving faster than this from one peer are dropped
+	pexMinReceiveInterval = 45 * time.Second
+	// most added and dropped entries per address family in one message
+	maxPexPeers = 50
+)
+
+type utPex struct {
+	pc *PeerConnection
+	// what the peer has heard from us so far, only touched by the swarm's
+	// pex loop
+	sent         map[Peer]struct{}
+	lastReceived time.Time
+}
+
+// NewUtPexExtension returns the BEP 11 peer exchange extension. Connections
+// of private torrents, whose peers may only come from trackers, go without it
+func NewUtPexExtension() ExtensionFactory {
+	return func(pc *PeerConnection) ExtensionHandler {
+		if pc.torrentInfo.Private() {
+			return nil
+		}
+		return &utPex{pc: pc, sent: make(map[Peer]struct{})}
+	}
+}
+
+func (ut *utPex) disabled() bool {
+	return ut.pc.swarm == nil
+}
+
+func (ut *utPex) OnHandshake(hs *ExtendedHandshake) error {
+	if _, ok := hs.M[UtPexName]; !ok || ut.disabled() {
+		return nil
+	}
+
+	ut.pc.swarm.addPex(ut.pc, ut)
+	return nil
+}
+
+func (ut *utPex) HandleMessage(payload []byte) error {
+	if ut.disabled() {
+		return nil
+	}
+
+	if !ut.lastReceived.IsZero() && time.Since(ut.lastReceived) < pexMinReceiveInterval {
+		log.Printf("Peer %s: pex message too soon, ignoring\n", ut.pc.peer.String())
+		return nil
+	}
+	ut.lastReceived = time.Now()
+
+	parser, _ := torrent.NewParserFromData(payload)
+	root, err := parser.Parse()
+	if err != nil {
+		return fmt.Errorf("invalid ut_pex message: %w", err)
+	}
+
+	dict := root.AsDict()
+	if dict == nil {
+		return fmt.Errorf("invalid ut_pex message: not a dictionary")
+	}
+
+	peers := parsePexPeers(dict["added"].AsString(), 4)
+	peers = append(peers, parsePexPeers(dict["added6"].AsString(), 16)...)
+	if len(peers) > 0 {
+		ut.pc.swarm.AddPeers(peers)
+	}
+
+	return nil
+}
+
+// parsePexPeers reads a compact peer list, ignoring entries past the BEP 11
+// limit
+func parsePexPeers(blob string, ipLen int) []Peer {
+	entryLen := ipLen + 2
+
+	var peers []Peer
+	for i := 0; i+entryLen <= len(blob) && len(peers) < maxPexPeers; i += entryLen {
+		addr, ok := decodeCompactAddr(blob[i : i+entryLen])
+		if !ok || addr.Port() == 0 || !addr.Addr().IsValid() {
+			continue
+		}
+		peers = append(peers, NewPeer(addr))
+	}
+
+	return peers
+}
+
+// update tells the peer which of the swarm's peers are new since the last
+// message and which ones are gone
+func (ut *utPex) update(current map[Peer]byte) error {
+	self, _ := ut.pc.pexAddr()
+
+	var added, dropped []Peer
+	for peer := range current {
+		if _, ok := ut.sent[peer]; !ok && peer != self {
+			added = append(added, peer)
+		}
+	}
+	for peer := range ut.sent {
+		if _, ok := current[peer]; !ok {
+			dropped = append(dropped, peer)
+		}
+	}
+
+	if len(added) == 0 && len(dropped) == 0 {
+		return nil
+	}
+
+	var added4, added6, flags4, flags6, dropped4, dropped6 []byte
+	count4, count6 := 0, 0
+	for _, peer := range added {
+		addr := peer.AddrPort()
+		if addr.Addr().Is4() {
+			if count4 == maxPexPeers {
+				continue
+			}
+			count4++
+			added4 = append(added4, encodeCompactAddr(addr)...)
+			flags4 = append(flags4, current[peer])
+		} else {
+			if count6 == maxPexPeers {
+				continue
+			}
+			count6++
+			added6 = append(added6, encodeCompactAddr(addr)...)
+			flags6 = append(flags6, current[peer])
+		}
+		ut.sent[peer] = struct{}{}
+	}
+
+	count4, count6 = 0, 0
+	for _, peer := range dropped {
+		addr := peer.AddrPort()
+		if addr.Addr().Is4() {
+			if count4 == maxPexPeers {
+				continue
+			}
+			count4++
+			dropped4 = append(dropped4, encodeCompactAddr(addr)...)
+		} else {
+			if count6 == maxPexPeers {
+				continue
+			}
+			count6++
+			dropped6 = append(dropped6, encodeCompactAddr(addr)...)
+		}
+		delete(ut.sent, peer)
+	}
+
+	msg := map[string]torrent.Node{
+		"added":    {Value: string(added4)},
+		"added.f":  {Value: string(flags4)},
+		"added6":   {Value: string(added6)},
+		"added6.f": {Value: string(flags6)},
+		"dropped":  {Value: string(dropped4)},
+		"dropped6": {Value: string(dropped6)},
+	}
+
+	return ut.pc.SendExtension(UtPexName, msg, nil)
+}
+
+// pexAddr returns the address other peers can reach this one on. Peers that
+// connected to us are only known by their listen port from the extended
+// handshake
+func (pc *PeerConnection) pexAddr() (Peer, bool) {
+	if !pc.incoming {
+		return pc.peer, true
+	}
+
+	port := pc.peerListenPort.Load()
+	if port <= 0 || port > 65535 {
+		return Peer{}, false
+	}
+
+	return NewPeer(netip.AddrPortFrom(pc.peer.AddrPort().Addr(), uint16(port))), true
+}
+
+func (s *Swarm) addPex(pc *PeerConnection, ut *utPex) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.conns[pc]; ok {
+		s.pex[pc] = ut
+	}
+}
+
+// pexPeers returns the addresses worth sharing with their flags
+func (s *Swarm) pexPeers() map[Peer]byte {
+	peers := make(map[Peer]byte)
+	for _, pc := range s.Peers() {
+		addr, ok := pc.pexAddr()
+		if !ok {
+			continue
+		}
+
+		var flags byte
+		if !pc.incoming {
+			flags |= pexReachable
+		}
+		if pc.peerSeed.Load() {
+			flags |= pexSeed
+		}
+		peers[addr] = flags
+	}
+
+	return peers
+}
+
+// RunPex sends peer exchange updates to every peer supporting ut_pex until
+// the swarm is closed. It returns at once for private torrents
+func (s *Swarm) RunPex() {
+	if s.torrentInfo.Private() {
+		return
+	}
+
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		current := s.pexPeers()
+
+		s.Lock()
+		handlers := make([]*utPex, 0, len(s.pex))
+		for _, ut := range s.pex {
+			handlers = append(handlers, ut)
+		}
+		s.Unlock()
+
+		for _, ut := range handlers {
+			if err := ut.update(current); err != nil {
+				log.Printf("Peer %s: pex: %v\n", ut.pc.peer.String(), err)
+			}
+		}
+	}
+}
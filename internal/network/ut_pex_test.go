@@ -0,0 +1,113 @@
+package network
+
+import (
+	"gotor/internal/testutil"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// sentExtendedHandshake returns the extended handshake pc sends to its peer
+func sentExtendedHandshake(t *testing.T, pc *PeerConnection) *ExtendedHandshake {
+	t.Helper()
+
+	messages := pipeMessages(t, pc)
+	if err := pc.sendExtendedHandshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := nextMessage(t, messages)
+	if MessageID(msg[0]) != MsgExtended || msg[1] != extHandshakeId {
+		t.Fatalf("sent message %d/%d, want the extended handshake", msg[0], msg[1])
+	}
+	hs, err := parseExtendedHandshake(msg[2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hs
+}
+
+func newPexTestConnection(t *testing.T, private bool) (*PeerConnection, *Swarm, byte) {
+	t.Helper()
+
+	extensions := NewExtensionRegistry()
+	if _, err := extensions.Register(UtMetadataName, NewUtMetadataExtension(NewMetadata([20]byte{}))); err != nil {
+		t.Fatal(err)
+	}
+	pexId, err := extensions.Register(UtPexName, NewUtPexExtension())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ti := testutil.NewTorrentInfo(t, 40000, 16384, private)
+	s := NewSwarm(ti, "peer", nil, nil, extensions, 0, NewConnLimiter(DefaultConnLimits()))
+	t.Cleanup(s.Close)
+
+	pc := NewPeerConnection(NewPeer(netip.MustParseAddrPort("192.0.2.1:6881")), ti, "peer", nil, nil, extensions)
+	pc.swarm = s
+	pc.supportsExtensions = true
+	pc.extHandlers = extensions.newHandlers(pc)
+
+	return pc, s, pexId
+}
+
+func TestPrivateTorrentOffersNoPex(t *testing.T) {
+	pc, _, _ := newPexTestConnection(t, true)
+
+	hs := sentExtendedHandshake(t, pc)
+	if _, ok := hs.M[UtPexName]; ok {
+		t.Errorf("private torrent offered %s: %v", UtPexName, hs.M)
+	}
+	if _, ok := hs.M[UtMetadataName]; !ok {
+		t.Errorf("%s missing from the handshake: %v", UtMetadataName, hs.M)
+	}
+}
+
+func TestPublicTorrentOffersPex(t *testing.T) {
+	pc, _, _ := newPexTestConnection(t, false)
+
+	hs := sentExtendedHandshake(t, pc)
+	if _, ok := hs.M[UtPexName]; !ok {
+		t.Errorf("%s missing from the handshake: %v", UtPexName, hs.M)
+	}
+}
+
+func TestPrivateTorrentIgnoresPex(t *testing.T) {
+	pc, s, pexId := newPexTestConnection(t, true)
+
+	// the peer offers ut_pex and sends us a peer anyway
+	if err := pc.handleExtended([]byte("\x00d1:md6:ut_pexi1eee")); err != nil {
+		t.Fatal(err)
+	}
+	added := "d5:added6:" + string([]byte{10, 0, 0, 1, 0x1a, 0xe1}) + "e"
+	if err := pc.handleExtended(append([]byte{pexId}, added...)); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Lock()
+	pex := len(s.pex)
+	s.Unlock()
+	if pex != 0 {
+		t.Errorf("%d connections take part in peer exchange", pex)
+	}
+	if known := s.ConnStats().Known; known != 0 {
+		t.Errorf("learned %d peers through peer exchange", known)
+	}
+}
+
+func TestRunPexReturnsForPrivateTorrents(t *testing.T) {
+	_, s, _ := newPexTestConnection(t, true)
+
+	done := make(chan struct{})
+	go func() {
+		s.RunPex()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("RunPex kept running for a private torrent")
+	}
+}
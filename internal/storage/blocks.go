@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"fmt"
+	"slices"
+)
+
+const BlockSize = 16 * 1024
+
+type Block struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+type blockState byte
+
+const (
+	blockMissing blockState = iota
+	blockRequested
+	blockReceived
+)
+
+// partialPiece is a piece being assembled from blocks that may come from
+// several peers. Received blocks survive chokes and disconnects, only the
+// outstanding requests are handed back. Outside of endgame a block has at
+// most one requesting peer
+type partialPiece struct {
+	blocks   []blockState
+	owners   [][]string
+	buffer   []byte
+	received int
+}
+
+// BlockResult describes what a received block completed
+type BlockResult struct {
+	// Piece holds the assembled piece once Complete is set
+	Piece    []byte
+	Complete bool
+	// Cancel lists other peers that requested the same block in endgame
+	// mode and should be sent a cancel
+	Cancel []string
+}
+
+func (pm *PieceManager) newPartialPiece(index int) *partialPiece {
+	length := pm.torrentInfo.PieceSize(index)
+	count := int((length + BlockSize - 1) / BlockSize)
+
+	pp := &partialPiece{
+		blocks: make([]blockState, count),
+		owners: make([][]string, count),
+		buffer: make([]byte, length),
+	}
+	pm.partial[index] = pp
+
+	return pp
+}
+
+func (pm *PieceManager) block(index int, pp *partialPiece, i int) Block {
+	begin := i * BlockSize
+	return Block{
+		Index:  index,
+		Begin:  begin,
+		Length: min(BlockSize, len(pp.buffer)-begin),
+	}
+}
+
+// PickBlocks hands out up to n blocks for the peer to request. Pieces that
+// are already partially downloaded are finished first so buffers don't pile
+// up, then new pieces are started with the configured strategy
+func (pm *PieceManager) PickBlocks(peer string, peerBitfield []bool, n int) []Block {
+	pm.Lock()
+	defer pm.Unlock()
+
+	var picked []Block
+
+	for index, pp := range pm.partial {
+		if len(picked) >= n {
+			return picked
+		}
+		if index >= len(peerBitfield) || !peerBitfield[index] {
+			continue
+		}
+
+		picked = pm.pickFromPiece(peer, index, pp, picked, n)
+	}
+
+	for len(picked) < n {
+		index, ok := pm.nextPiece(peerBitfield)
+		if !ok {
+			break
+		}
+
+		picked = pm.pickFromPiece(peer, index, pm.newPartialPiece(index), picked, n)
+	}
+
+	if len(picked) < n && pm.inEndgame() {
+		picked = pm.pickEndgame(peer, peerBitfield, picked, n)
+	}
+
+	return picked
+}
+
+// inEndgame reports whether every missing block is already requested, in which
+// case the remaining blocks are requested from several peers at once so the
+// last pieces don't wait for the slowest peer. Callers hold the lock
+func (pm *PieceManager) inEndgame() bool {
+	for _, state := range pm.states {
+		if state == Missing {
+			return false
+		}
+	}
+
+	for _, pp := range pm.partial {
+		for _, state := range pp.blocks {
+			if state == blockMissing {
+				return false
+			}
+		}
+	}
+
+	return len(pm.partial) > 0
+}
+
+func (pm *PieceManager) EndgameActive() bool {
+	pm.Lock()
+	defer pm.Unlock()
+
+	return pm.inEndgame()
+}
+
+func (pm *PieceManager) pickEndgame(peer string, peerBitfield []bool, picked []Block, n int) []Block {
+	for index, pp := range pm.partial {
+		if index >= len(peerBitfield) || !peerBitfield[index] {
+			continue
+		}
+
+		for i, state := range pp.blocks {
+			if len(picked) >= n {
+				return picked
+			}
+			if state != blockRequested || slices.Contains(pp.owners[i], peer) {
+				continue
+			}
+
+			pp.owners[i] = append(pp.owners[i], peer)
+			picked = append(picked, pm.block(index, pp, i))
+		}
+	}
+
+	return picked
+}
+
+func (pm *PieceManager) pickFromPiece(peer string, index int, pp *partialPiece, picked []Block, n int) []Block {
+	for i, state := range pp.blocks {
+		if len(picked) >= n {
+			break
+		}
+		if state != blockMissing {
+			continue
+		}
+
+		pp.blocks[i] = blockRequested
+		pp.owners[i] = []string{peer}
+		picked = append(picked, pm.block(index, pp, i))
+	}
+
+	return picked
+}
+
+// BlockReceived stores the data of a block. When it was the last missing
+// block the assembled piece is returned for verification
+func (pm *PieceManager) BlockReceived(peer string, block Block, data []byte) (BlockResult, error) {
+	pm.Lock()
+	defer pm.Unlock()
+
+	pp, ok := pm.partial[block.Index]
+	if !ok {
+		// the piece was finished or dropped meanwhile
+		return BlockResult{}, nil
+	}
+
+	if block.Begin%BlockSize != 0 || block.Begin >= len(pp.buffer) {
+		return BlockResult{}, fmt.Errorf("unexpected block offset %d in piece %d", block.Begin, block.Index)
+	}
+
+	i := block.Begin / BlockSize
+	expected := pm.block(block.Index, pp, i)
+	if len(data) != expected.Length {
+		return BlockResult{}, fmt.Errorf("block %d of piece %d has length %d, expected %d", i, block.Index, len(data), expected.Length)
+	}
+
+	if pp.blocks[i] == blockReceived {
+		return BlockResult{}, nil
+	}
+
+	var result BlockResult
+	for _, owner := range pp.owners[i] {
+		if owner != peer {
+			result.Cancel = append(result.Cancel, owner)
+		}
+	}
+
+	copy(pp.buffer[block.Begin:], data)
+	pp.blocks[i] = blockReceived
+	pp.owners[i] = nil
+	pp.received++
+
+	if pp.received == len(pp.blocks) {
+		result.Piece = pp.buffer
+		result.Complete = true
+	}
+
+	return result, nil
+}
+
+// ReleaseBlocks returns every block the peer requested but did not deliver,
+// so other peers can pick them up. Used on choke and disconnect
+func (pm *PieceManager) ReleaseBlocks(peer string) {
+	pm.Lock()
+	defer pm.Unlock()
+
+	for _, pp := range pm.partial {
+		for i := range pp.blocks {
+			pp.releaseBlock(i, peer)
+		}
+	}
+}
+
+// ReleaseBlock returns a single outstanding block, e.g. after a cancel
+func (pm *PieceManager) ReleaseBlock(peer string, block Block) {
+	pm.Lock()
+	defer pm.Unlock()
+
+	pp, ok := pm.partial[block.Index]
+	if !ok {
+		return
+	}
+
+	if i := block.Begin / BlockSize; i < len(pp.blocks) {
+		pp.releaseBlock(i, peer)
+	}
+}
+
+// releaseBlock drops the peer from the requesters of a block, which becomes
+// missing again once nobody is left asking for it
+func (pp *partialPiece) releaseBlock(i int, peer string) {
+	if pp.blocks[i] != blockRequested {
+		return
+	}
+
+	pp.owners[i] = slices.DeleteFunc(pp.owners[i], func(owner string) bool {
+		return owner == peer
+	})
+	if len(pp.owners[i]) == 0 {
+		pp.blocks[i] = blockMissing
+	}
+}
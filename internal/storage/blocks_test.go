@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"gotor/internal/testutil"
+	"slices"
+	"testing"
+)
+
+// the last blocks are requested from a second peer once the first one holds
+// every missing block, and the fast peer's copy completes the pieces
+func TestEndgameCompletesWithoutStalledPeer(t *testing.T) {
+	ti := testutil.NewTorrentInfo(t, 2*BlockSize+BlockSize/2, 2*BlockSize, false)
+	pm := NewPieceManager(ti)
+	bitfield := allPieces(ti.PieceCount())
+
+	stalled := pm.PickBlocks("stalled", bitfield, 10)
+	if len(stalled) != 3 {
+		t.Fatalf("stalled peer got %d blocks, want 3", len(stalled))
+	}
+	if !pm.EndgameActive() {
+		t.Fatal("endgame not active with every block requested")
+	}
+
+	fast := pm.PickBlocks("fast", bitfield, 10)
+	if len(fast) != len(stalled) {
+		t.Fatalf("fast peer got %d blocks, want %d", len(fast), len(stalled))
+	}
+
+	completed := 0
+	for _, block := range fast {
+		result, err := pm.BlockReceived("fast", block, make([]byte, block.Length))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(result.Cancel, []string{"stalled"}) {
+			t.Errorf("block %+v: cancel %v, want [stalled]", block, result.Cancel)
+		}
+		if result.Complete {
+			completed++
+			pm.MarkAsCompleted(block.Index)
+		}
+	}
+
+	if completed != ti.PieceCount() {
+		t.Fatalf("%d pieces completed, want %d", completed, ti.PieceCount())
+	}
+
+	select {
+	case <-pm.Done():
+	default:
+		t.Fatal("download not done")
+	}
+
+	// the stalled peer showing up late changes nothing
+	result, err := pm.BlockReceived("stalled", stalled[0], make([]byte, stalled[0].Length))
+	if err != nil || result.Complete {
+		t.Fatalf("late block: %+v, %v", result, err)
+	}
+}
+
+func TestEndgameSkipsBlocksThePeerAlreadyRequested(t *testing.T) {
+	ti := testutil.NewTorrentInfo(t, 2*BlockSize, 2*BlockSize, false)
+	pm := NewPieceManager(ti)
+	bitfield := allPieces(ti.PieceCount())
+
+	first := pm.PickBlocks("a", bitfield, 10)
+	if again := pm.PickBlocks("a", bitfield, 10); len(again) != 0 {
+		t.Fatalf("peer got its own blocks again: %v", again)
+	}
+
+	// once the other peer is gone its blocks are missing again
+	pm.ReleaseBlocks("a")
+	if picked := pm.PickBlocks("b", bitfield, 10); len(picked) != len(first) {
+		t.Fatalf("got %d blocks after release, want %d", len(picked), len(first))
+	}
+	if !pm.EndgameActive() {
+		t.Fatal("endgame should be active again")
+	}
+}
@@ -69,6 +69,58 @@ func (fm *FileManager) Write(globalOffset int64, data []byte) {
 	}
 }
 
+// Read returns length bytes starting at globalOffset, spanning file
+// boundaries the same way Write does
+func (fm *FileManager) Read(globalOffset int64, length int) ([]byte, error) {
+	fm.Lock()
+	defer fm.Unlock()
+
+	if globalOffset < 0 || length < 0 || globalOffset+int64(length) > fm.torrentInfo.TotalLength() {
+		return nil, fmt.Errorf("read out of bounds: offset=%d length=%d", globalOffset, length)
+	}
+
+	data := make([]byte, length)
+	currentGlobalPos := globalOffset
+	dataBytesRead := int64(0)
+	bytesLeft := int64(length)
+
+	for _, file := range fm.torrentInfo.Files() {
+		if file.EndOffset <= currentGlobalPos {
+			continue
+		}
+
+		if file.StartOffset >= currentGlobalPos+bytesLeft {
+			break
+		}
+
+		fileSeekPos := currentGlobalPos - file.StartOffset
+		bytesForThisFile := min(bytesLeft, file.Length-fileSeekPos)
+		if err := fm.readFromFile(file, fileSeekPos, data[dataBytesRead:dataBytesRead+bytesForThisFile]); err != nil {
+			return nil, err
+		}
+
+		currentGlobalPos += bytesForThisFile
+		dataBytesRead += bytesForThisFile
+		bytesLeft -= bytesForThisFile
+
+		if bytesLeft == 0 {
+			break
+		}
+	}
+
+	return data, nil
+}
+
+func (fm *FileManager) readFromFile(file torrent.FileInfo, fileOffset int64, data []byte) error {
+	f, ok := fm.openFiles[file.Path]
+	if !ok {
+		return fmt.Errorf("file %s not found in open files", file.Path)
+	}
+
+	_, err := f.ReadAt(data, fileOffset)
+	return err
+}
+
 func (fm *FileManager) writeToFile(file torrent.FileInfo, fileOffset int64, data []byte, length int64) error {
 	f, ok := fm.openFiles[file.Path]
 	if !ok {
@@ -0,0 +1,9 @@
+package storage
+
+func allPieces(count int) []bool {
+	bitfield := make([]bool, count)
+	for i := range bitfield {
+		bitfield[i] = true
+	}
+	return bitfield
+}
@@ -1,6 +1,9 @@
 package storage
 
 import (
+	"fmt"
+	"gotor/internal/torrent"
+	"math/rand"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,9 +17,33 @@ const (
 	Have
 )
 
+type PickStrategy byte
+
+const (
+	RarestFirst PickStrategy = iota
+	Sequential
+)
+
+func ParsePickStrategy(name string) (PickStrategy, error) {
+	switch name {
+	case "rarest":
+		return RarestFirst, nil
+	case "sequential":
+		return Sequential, nil
+	default:
+		return 0, fmt.Errorf("unknown piece strategy: %s", name)
+	}
+}
+
 type PieceManager struct {
 	states               []PieceManagerState
+	availability         []int
+	strategy             PickStrategy
+	torrentInfo          torrent.TorrentInfo
+	partial              map[int]*partialPiece
+	done                 chan struct{}
 	totalBytesDownloaded atomic.Uint64
+	totalBytesUploaded   atomic.Uint64
 	sync.Mutex
 
 	lastBytes    uint64
@@ -55,36 +82,151 @@ func (pm *PieceManager) GetSpeed() float64 {
 	return pm.currentSpeed
 }
 
-func NewPieceManager(totalPieces int) *PieceManager {
+func NewPieceManager(torrentInfo torrent.TorrentInfo) *PieceManager {
+	totalPieces := torrentInfo.PieceCount()
 	pm := &PieceManager{
-		states: make([]PieceManagerState, totalPieces)}
+		states:       make([]PieceManagerState, totalPieces),
+		availability: make([]int, totalPieces),
+		strategy:     RarestFirst,
+		torrentInfo:  torrentInfo,
+		partial:      make(map[int]*partialPiece),
+		done:         make(chan struct{}),
+	}
 
 	return pm
 }
 
-func (pm *PieceManager) GetNextPieceToDownload(peerBitfield []bool) (int, bool) {
-	pm.Lock()
-	defer pm.Unlock()
-
+// nextPiece picks a missing piece the peer has and marks it in progress.
+// Callers hold the lock
+func (pm *PieceManager) nextPiece(peerBitfield []bool) (int, bool) {
 	if len(peerBitfield) == 0 {
 		return 0, false
 	}
 
+	if pm.strategy == Sequential {
+		for i, state := range pm.states {
+			if i < len(peerBitfield) && state == Missing && peerBitfield[i] {
+				pm.states[i] = InProgress
+				return i, true
+			}
+		}
+
+		return 0, false
+	}
+
+	// rarest first, ties are broken at random so peers with the same view
+	// of the swarm don't all start on the same piece
+	best := -1
+	ties := 0
 	for i, state := range pm.states {
-		if i < len(peerBitfield) && state == Missing && peerBitfield[i] {
-			pm.states[i] = InProgress
-			return i, true
+		if i >= len(peerBitfield) || state != Missing || !peerBitfield[i] {
+			continue
 		}
+
+		switch {
+		case best == -1 || pm.availability[i] < pm.availability[best]:
+			best = i
+			ties = 1
+		case pm.availability[i] == pm.availability[best]:
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = i
+			}
+		}
+	}
+
+	if best == -1 {
+		return 0, false
+	}
+
+	pm.states[best] = InProgress
+	return best, true
+}
+
+func (pm *PieceManager) SetStrategy(strategy PickStrategy) {
+	pm.Lock()
+	defer pm.Unlock()
+
+	pm.strategy = strategy
+}
+
+// AddPeerBitfield counts the pieces of a newly known peer towards availability
+func (pm *PieceManager) AddPeerBitfield(peerBitfield []bool) {
+	pm.updateAvailability(peerBitfield, 1)
+}
+
+// RemovePeerBitfield undoes AddPeerBitfield and AddPeerPiece when a peer leaves
+func (pm *PieceManager) RemovePeerBitfield(peerBitfield []bool) {
+	pm.updateAvailability(peerBitfield, -1)
+}
+
+func (pm *PieceManager) AddPeerPiece(index int) {
+	pm.Lock()
+	defer pm.Unlock()
+
+	if index >= 0 && index < len(pm.availability) {
+		pm.availability[index]++
 	}
+}
 
-	return 0, false
+func (pm *PieceManager) updateAvailability(peerBitfield []bool, delta int) {
+	pm.Lock()
+	defer pm.Unlock()
+
+	for i, has := range peerBitfield {
+		if i >= len(pm.availability) {
+			break
+		}
+		if has {
+			pm.availability[i] = max(0, pm.availability[i]+delta)
+		}
+	}
+}
+
+func (pm *PieceManager) Availability(index int) int {
+	pm.Lock()
+	defer pm.Unlock()
+
+	return pm.availability[index]
 }
 
 func (pm *PieceManager) MarkAsCompleted(index int) {
 	pm.Lock()
 	defer pm.Unlock()
 
+	if pm.states[index] == Have {
+		return
+	}
+
 	pm.states[index] = Have
+	delete(pm.partial, index)
+
+	for _, state := range pm.states {
+		if state != Have {
+			return
+		}
+	}
+	close(pm.done)
+}
+
+// Done is closed once every piece has been verified
+func (pm *PieceManager) Done() <-chan struct{} {
+	return pm.done
+}
+
+// BytesLeft is the amount of data still missing, as reported to trackers
+func (pm *PieceManager) BytesLeft() int64 {
+	pm.Lock()
+	defer pm.Unlock()
+
+	var left int64
+	for i, state := range pm.states {
+		if state != Have {
+			left += pm.torrentInfo.PieceSize(i)
+		}
+	}
+
+	return left
 }
 
 func (pm *PieceManager) MarkAsFailed(index int) {
@@ -92,6 +234,31 @@ func (pm *PieceManager) MarkAsFailed(index int) {
 	defer pm.Unlock()
 
 	pm.states[index] = Missing
+	delete(pm.partial, index)
+}
+
+func (pm *PieceManager) Has(index int) bool {
+	pm.Lock()
+	defer pm.Unlock()
+
+	return index >= 0 && index < len(pm.states) && pm.states[index] == Have
+}
+
+// Bitfield returns our pieces in wire format and whether we have any at all
+func (pm *PieceManager) Bitfield() ([]byte, bool) {
+	pm.Lock()
+	defer pm.Unlock()
+
+	bitfield := make([]byte, (len(pm.states)+7)/8)
+	hasPieces := false
+	for i, s := range pm.states {
+		if s == Have {
+			bitfield[i/8] |= 1 << (7 - uint(i%8))
+			hasPieces = true
+		}
+	}
+
+	return bitfield, hasPieces
 }
 
 func (pm *PieceManager) Progress() float32 {
@@ -112,6 +279,18 @@ func (pm *PieceManager) AddBytes(n uint64) {
 	pm.totalBytesDownloaded.Add(n)
 }
 
+func (pm *PieceManager) AddUploadedBytes(n uint64) {
+	pm.totalBytesUploaded.Add(n)
+}
+
+func (pm *PieceManager) TotalDownloaded() uint64 {
+	return pm.totalBytesDownloaded.Load()
+}
+
+func (pm *PieceManager) TotalUploaded() uint64 {
+	return pm.totalBytesUploaded.Load()
+}
+
 func (pm *PieceManager) StatesInt() []int {
 	pm.Lock()
 	defer pm.Unlock()
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"gotor/internal/testutil"
+	"testing"
+)
+
+func TestLastPieceBlocks(t *testing.T) {
+	tests := []struct {
+		length      int
+		pieceLength int
+		lastBlocks  []int
+	}{
+		{3*BlockSize + 100, 2 * BlockSize, []int{BlockSize, 100}},
+		{2*BlockSize + 100, 2 * BlockSize, []int{100}},
+		{4 * BlockSize, 2 * BlockSize, []int{BlockSize, BlockSize}},
+		{BlockSize / 2, 2 * BlockSize, []int{BlockSize / 2}},
+	}
+
+	for _, tt := range tests {
+		ti := testutil.NewTorrentInfo(t, tt.length, tt.pieceLength, false)
+		pm := NewPieceManager(ti)
+
+		last := ti.PieceCount() - 1
+		pp := pm.newPartialPiece(last)
+		if len(pp.blocks) != len(tt.lastBlocks) {
+			t.Fatalf("length %d: last piece has %d blocks, want %d", tt.length, len(pp.blocks), len(tt.lastBlocks))
+		}
+
+		for i, want := range tt.lastBlocks {
+			block := pm.block(last, pp, i)
+			if block.Begin != i*BlockSize || block.Length != want {
+				t.Errorf("length %d: block %d is %+v, want length %d", tt.length, i, block, want)
+			}
+		}
+	}
+}
+
+func TestLastPieceCompletes(t *testing.T) {
+	ti := testutil.NewTorrentInfo(t, 3*BlockSize+100, 2*BlockSize, false)
+	pm := NewPieceManager(ti)
+
+	blocks := pm.PickBlocks("peer", allPieces(ti.PieceCount()), 10)
+
+	var last []byte
+	for _, block := range blocks {
+		result, err := pm.BlockReceived("peer", block, make([]byte, block.Length))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Complete && block.Index == ti.PieceCount()-1 {
+			last = result.Piece
+		}
+	}
+
+	if int64(len(last)) != ti.PieceSize(ti.PieceCount()-1) {
+		t.Fatalf("last piece has %d bytes, want %d", len(last), ti.PieceSize(ti.PieceCount()-1))
+	}
+
+	// a short block of the wrong length is refused
+	if _, err := pm.BlockReceived("peer", Block{Index: 1, Begin: BlockSize, Length: 101}, make([]byte, 101)); err == nil {
+		t.Fatal("expected a length error")
+	}
+}
@@ -0,0 +1,52 @@
+package testutil
+
+import (
+	"gotor/internal/torrent"
+	"strings"
+	"testing"
+)
+
+// NewTorrentInfo builds a single file torrent of the given size, the piece
+// hashes are placeholders
+func NewTorrentInfo(t testing.TB, length int, pieceLength int, private bool) torrent.TorrentInfo {
+	t.Helper()
+
+	count := (length + pieceLength - 1) / pieceLength
+	info := map[string]torrent.Node{
+		"name":         {Value: "test"},
+		"length":       {Value: length},
+		"piece length": {Value: pieceLength},
+		"pieces":       {Value: strings.Repeat("h", 20*count)},
+	}
+	if private {
+		info["private"] = torrent.Node{Value: 1}
+	}
+
+	return NewTorrentInfoFromDict(t, info)
+}
+
+// NewTorrentInfoFromDict builds a torrent around the given info dictionary
+func NewTorrentInfoFromDict(t testing.TB, info map[string]torrent.Node) torrent.TorrentInfo {
+	t.Helper()
+
+	raw, err := torrent.Encode(torrent.Node{Value: info})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parser, err := torrent.NewParserFromData(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infoNode, err := parser.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ti, err := torrent.NewTorrentInfoFromNode(torrent.Node{Value: map[string]torrent.Node{"info": infoNode}}, string(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return *ti
+}
@@ -0,0 +1,65 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Encode serializes a node back into bencode. Dictionary keys are written in
+// sorted order as the spec requires
+func Encode(node Node) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeNode(&buf, node); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func encodeNode(buf *bytes.Buffer, node Node) error {
+	switch v := node.Value.(type) {
+	case int:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.Itoa(v))
+		buf.WriteByte('e')
+	case int64:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatInt(v, 10))
+		buf.WriteByte('e')
+	case string:
+		buf.WriteString(strconv.Itoa(len(v)))
+		buf.WriteByte(':')
+		buf.WriteString(v)
+	case []Node:
+		buf.WriteByte('l')
+		for _, item := range v {
+			if err := encodeNode(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case map[string]Node:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buf.WriteByte('d')
+		for _, key := range keys {
+			buf.WriteString(strconv.Itoa(len(key)))
+			buf.WriteByte(':')
+			buf.WriteString(key)
+			if err := encodeNode(buf, v[key]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return fmt.Errorf("cannot encode type %T", v)
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package torrent
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const btihPrefix = "urn:btih:"
+
+type Magnet struct {
+	InfoHash    [20]byte
+	DisplayName string
+	Trackers    []string
+	WebSeeds    []string
+	Peers       []string
+}
+
+func IsMagnet(uri string) bool {
+	return strings.HasPrefix(strings.ToLower(uri), "magnet:")
+}
+
+// ParseMagnet reads the info hash, display name, trackers, web seeds and
+// direct peers of a magnet link. A BEP 53 "so" file selection is ignored,
+// every file of the torrent is downloaded
+func ParseMagnet(magnet string) (*Magnet, error) {
+	if !IsMagnet(magnet) {
+		return nil, errors.New("not a magnet uri")
+	}
+
+	_, rawQuery, _ := strings.Cut(magnet, "?")
+
+	// url.ParseQuery treats '+' as a space which is what most clients expect in dn
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid magnet query: %w", err)
+	}
+
+	m := &Magnet{}
+
+	found := false
+	for _, xt := range query["xt"] {
+		if !strings.HasPrefix(strings.ToLower(xt), btihPrefix) {
+			// btmh (v2) and other urns are not supported, skip them
+			continue
+		}
+
+		hash, err := decodeInfoHash(xt[len(btihPrefix):])
+		if err != nil {
+			return nil, err
+		}
+		m.InfoHash = hash
+		found = true
+		break
+	}
+
+	if !found {
+		return nil, errors.New("magnet has no urn:btih exact topic")
+	}
+
+	m.DisplayName = query.Get("dn")
+	m.Trackers = uniqueNonEmpty(query["tr"])
+	m.WebSeeds = uniqueNonEmpty(query["ws"])
+	m.Peers = uniqueNonEmpty(query["x.pe"])
+
+	return m, nil
+}
+
+func decodeInfoHash(encoded string) ([20]byte, error) {
+	var hash [20]byte
+
+	var raw []byte
+	var err error
+	switch len(encoded) {
+	case 40:
+		raw, err = hex.DecodeString(encoded)
+	case 32:
+		raw, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+	default:
+		return hash, fmt.Errorf("invalid info hash length: %d", len(encoded))
+	}
+
+	if err != nil {
+		return hash, fmt.Errorf("invalid info hash: %w", err)
+	}
+
+	copy(hash[:], raw)
+	return hash, nil
+}
+
+func uniqueNonEmpty(values []string) []string {
+	seen := make(map[string]bool, len(values))
+
+	var result []string
+	for _, v := range values {
+		if v == "" || seen[v] {
+			continue
+		}
+		seen[v] = true
+		result = append(result, v)
+	}
+
+	return result
+}
@@ -0,0 +1,70 @@
+package torrent
+
+import (
+	"slices"
+	"testing"
+)
+
+var testMagnetHash = [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+
+func TestParseMagnet(t *testing.T) {
+	m, err := ParseMagnet("magnet:?xt=urn:btih:0102030405060708090a0b0c0d0e0f1011121314" +
+		"&dn=Some+File%21" +
+		"&tr=udp%3A%2F%2Ftracker.example%3A6969&tr=http%3A%2F%2Fexample.com%2Fannounce&tr=udp%3A%2F%2Ftracker.example%3A6969&tr=" +
+		"&ws=http%3A%2F%2Fseed.example%2Ffile" +
+		"&x.pe=10.0.0.1%3A6881&x.pe=%5B2001%3Adb8%3A%3A1%5D%3A51413" +
+		"&so=0,2-4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.InfoHash != testMagnetHash {
+		t.Errorf("info hash %x", m.InfoHash)
+	}
+	if m.DisplayName != "Some File!" {
+		t.Errorf("display name %q", m.DisplayName)
+	}
+	if want := []string{"udp://tracker.example:6969", "http://example.com/announce"}; !slices.Equal(m.Trackers, want) {
+		t.Errorf("trackers %v, want %v", m.Trackers, want)
+	}
+	if want := []string{"http://seed.example/file"}; !slices.Equal(m.WebSeeds, want) {
+		t.Errorf("web seeds %v, want %v", m.WebSeeds, want)
+	}
+	if want := []string{"10.0.0.1:6881", "[2001:db8::1]:51413"}; !slices.Equal(m.Peers, want) {
+		t.Errorf("peers %v, want %v", m.Peers, want)
+	}
+}
+
+func TestParseMagnetBase32(t *testing.T) {
+	for _, uri := range []string{
+		"magnet:?xt=urn:btih:aebagbafaydqqcikbmga2dqpcaireeyu",
+		"MAGNET:?xt=URN:BTIH:AEBAGBAFAYDQQCIKBMGA2DQPCAIREEYU",
+		// a v2 topic comes first and is skipped
+		"magnet:?xt=urn:btmh:1220abcd&xt=urn:btih:AEBAGBAFAYDQQCIKBMGA2DQPCAIREEYU",
+	} {
+		m, err := ParseMagnet(uri)
+		if err != nil {
+			t.Errorf("%s: %v", uri, err)
+			continue
+		}
+		if m.InfoHash != testMagnetHash {
+			t.Errorf("%s: info hash %x", uri, m.InfoHash)
+		}
+	}
+}
+
+func TestParseMagnetMalformed(t *testing.T) {
+	for _, uri := range []string{
+		"http://example.com/?xt=urn:btih:0102030405060708090a0b0c0d0e0f1011121314",
+		"magnet:?dn=no+topic",
+		"magnet:?xt=urn:btmh:1220abcd",
+		"magnet:?xt=urn:btih:0102",
+		"magnet:?xt=urn:btih:zz02030405060708090a0b0c0d0e0f1011121314",
+		"magnet:?xt=urn:btih:1ebagbafaydqqcikbmga2dqpcaireeyu",
+		"magnet:?xt=urn:btih:0102030405060708090a0b0c0d0e0f1011121314&dn=%zz",
+	} {
+		if _, err := ParseMagnet(uri); err == nil {
+			t.Errorf("%s: expected an error", uri)
+		}
+	}
+}
@@ -68,11 +68,6 @@ func NewParserFromData(data []byte) (*Parser, error) {
 	return &Parser{buffer: buf}, nil
 }
 
-func NewParserFromMagnet(magnet string) (*Parser, error) {
-	// TODO: implement
-	return nil, errors.New("magnet is not yet supported")
-}
-
 func (p *Parser) InfoRaw() string {
 	return p.infoRaw
 }
@@ -94,7 +89,27 @@ func (p *Parser) Parse() (Node, error) {
 	return root, nil
 }
 
+// ParsePrefix parses a single element from the start of the buffer and
+// returns it together with the number of bytes it occupied. Extension
+// messages carry raw data right after a bencoded dictionary
+func (p *Parser) ParsePrefix() (Node, int, error) {
+	if len(p.buffer) == 0 {
+		return Node{}, 0, errors.New("data is empty")
+	}
+
+	root, err := p.parseElement()
+	if err != nil {
+		return Node{}, 0, err
+	}
+
+	return root, p.pos, nil
+}
+
 func (p *Parser) parseElement() (Node, error) {
+	if p.pos >= len(p.buffer) {
+		return Node{}, errors.New("unexpected end of data")
+	}
+
 	current := p.buffer[p.pos]
 
 	switch {
@@ -153,11 +168,15 @@ func (p *Parser) parseString() (Node, error) {
 	if err != nil {
 		return Node{}, fmt.Errorf("invalid length: %w", err)
 	}
+	if length < 0 {
+		return Node{}, fmt.Errorf("negative string length: %d", length)
+	}
 
 	// jump over the ':'
 	p.pos++
 
-	if p.pos+length > len(p.buffer) {
+	// p.pos+length could overflow for lengths near the int limit
+	if length > len(p.buffer)-p.pos {
 		return Node{}, errors.New("string length out of bounds")
 	}
 
@@ -205,12 +224,20 @@ func (p *Parser) parseDict() (Node, error) {
 		startPos := p.pos
 
 		valueNode, err := p.parseElement()
+		if err != nil {
+			return Node{}, err
+		}
 		dict[key] = valueNode
 
 		if isInfoKey {
 			p.infoRaw = string(p.buffer[startPos:p.pos])
 		}
 	}
+
+	if p.pos >= len(p.buffer) {
+		return Node{}, errors.New("unexpected end of file dict")
+	}
+
 	// skip 'e'
 	p.pos++
 
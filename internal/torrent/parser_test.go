@@ -0,0 +1,35 @@
+package torrent
+
+import "testing"
+
+func TestParseString(t *testing.T) {
+	parser, err := NewParserFromData([]byte("d1:t2:aa1:y1:qe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := parser.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := root.AsDict()["t"].AsString(); got != "aa" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestParseStringLengthOutOfBounds(t *testing.T) {
+	for _, data := range []string{
+		"d1:t9223372036854775807:xe",
+		"d1:t9223372036854775806:xe",
+		"3:ab",
+		"-1:a",
+	} {
+		parser, err := NewParserFromData([]byte(data))
+		if err != nil {
+			continue
+		}
+		if _, err := parser.Parse(); err == nil {
+			t.Errorf("%q: expected an error", data)
+		}
+	}
+}
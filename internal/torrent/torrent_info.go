@@ -3,6 +3,8 @@ package torrent
 import (
 	"crypto/sha1"
 	"errors"
+	"fmt"
+	"slices"
 )
 
 type FileInfo struct {
@@ -14,23 +16,98 @@ type FileInfo struct {
 
 type TorrentInfo struct {
 	infoHash [20]byte
+	infoRaw  string
 	files    []FileInfo
 
-	announce    string
-	pieceLength int64
-	pieces      string
-	name        string
-	totalLength int64
+	announce     string
+	announceList [][]string
+	trackers     []string
+	webSeeds     []string
+	peers        []string
+	pieceLength  int64
+	pieces       string
+	name         string
+	private      bool
+	totalLength  int64
 }
 
 func (ti *TorrentInfo) InfoHash() [20]byte {
 	return ti.infoHash
 }
 
+// InfoRaw returns the bencoded info dictionary exactly as it was hashed
+func (ti *TorrentInfo) InfoRaw() string {
+	return ti.infoRaw
+}
+
 func (ti *TorrentInfo) Announce() string {
 	return ti.announce
 }
 
+// Trackers returns every known tracker url, announce first
+func (ti *TorrentInfo) Trackers() []string {
+	var result []string
+	if ti.announce != "" {
+		result = append(result, ti.announce)
+	}
+
+	for _, tier := range ti.announceList {
+		for _, tr := range tier {
+			if !slices.Contains(result, tr) {
+				result = append(result, tr)
+			}
+		}
+	}
+
+	for _, tr := range ti.trackers {
+		if !slices.Contains(result, tr) {
+			result = append(result, tr)
+		}
+	}
+
+	return result
+}
+
+// Tiers returns the trackers grouped into BEP 12 tiers. Without an
+// announce-list every known tracker is a tier of its own
+func (ti *TorrentInfo) Tiers() [][]string {
+	if len(ti.announceList) > 0 {
+		tiers := make([][]string, len(ti.announceList))
+		for i, tier := range ti.announceList {
+			tiers[i] = append([]string(nil), tier...)
+		}
+		return tiers
+	}
+
+	var tiers [][]string
+	for _, tr := range ti.Trackers() {
+		tiers = append(tiers, []string{tr})
+	}
+
+	return tiers
+}
+
+func (ti *TorrentInfo) WebSeeds() []string {
+	return ti.webSeeds
+}
+
+// Peers returns direct peer addresses (host:port) that came with a magnet link
+func (ti *TorrentInfo) Peers() []string {
+	return ti.peers
+}
+
+// HasMetadata reports whether the info dictionary is known. Torrents created
+// from a magnet link only have the info hash until metadata is fetched
+func (ti *TorrentInfo) HasMetadata() bool {
+	return len(ti.pieces) > 0
+}
+
+// Private reports the BEP 27 private flag. Peers of a private torrent may
+// only come from its trackers
+func (ti *TorrentInfo) Private() bool {
+	return ti.private
+}
+
 func (ti *TorrentInfo) PieceLength() int64 {
 	return ti.pieceLength
 }
@@ -56,6 +133,18 @@ func NewTorrentInfoFromNode(root Node, rawInfoBytes string) (*TorrentInfo, error
 		torrentInfo.announce = rootDict["announce"].AsString()
 	}
 
+	for _, tierNode := range rootDict["announce-list"].AsList() {
+		var tier []string
+		for _, tr := range tierNode.AsList() {
+			if tr.AsString() != "" {
+				tier = append(tier, tr.AsString())
+			}
+		}
+		if len(tier) > 0 {
+			torrentInfo.announceList = append(torrentInfo.announceList, tier)
+		}
+	}
+
 	infoDict := rootDict["info"].AsDict()
 	if infoDict == nil {
 		return nil, errors.New("no info dictionary found")
@@ -64,9 +153,11 @@ func NewTorrentInfoFromNode(root Node, rawInfoBytes string) (*TorrentInfo, error
 	torrentInfo.name = infoDict["name"].AsString()
 	torrentInfo.pieceLength = infoDict["piece length"].asInt64()
 	torrentInfo.pieces = infoDict["pieces"].AsString()
+	torrentInfo.private = infoDict["private"].AsInt() == 1
 
 	hash := sha1.Sum([]byte(rawInfoBytes))
 	torrentInfo.infoHash = hash
+	torrentInfo.infoRaw = rawInfoBytes
 
 	// multi-file
 	if filesList := infoDict["files"].AsList(); filesList != nil {
@@ -102,6 +193,74 @@ func NewTorrentInfoFromNode(root Node, rawInfoBytes string) (*TorrentInfo, error
 		currentOffset += torrentInfo.files[i].Length
 		torrentInfo.files[i].EndOffset = currentOffset
 	}
+
+	if torrentInfo.pieceLength <= 0 {
+		return nil, errors.New("invalid piece length")
+	}
+
+	if len(torrentInfo.pieces)%20 != 0 {
+		return nil, errors.New("pieces length is not a multiple of 20")
+	}
+
+	expectedPieces := (torrentInfo.totalLength + torrentInfo.pieceLength - 1) / torrentInfo.pieceLength
+	if int64(torrentInfo.PieceCount()) != expectedPieces {
+		return nil, fmt.Errorf("torrent has %d piece hashes, expected %d", torrentInfo.PieceCount(), expectedPieces)
+	}
+
+	return torrentInfo, nil
+}
+
+func NewTorrentInfoFromMagnet(magnet *Magnet) *TorrentInfo {
+	torrentInfo := &TorrentInfo{
+		infoHash: magnet.InfoHash,
+		name:     magnet.DisplayName,
+		trackers: magnet.Trackers,
+		webSeeds: magnet.WebSeeds,
+		peers:    magnet.Peers,
+	}
+
+	if len(magnet.Trackers) > 0 {
+		torrentInfo.announce = magnet.Trackers[0]
+	}
+
+	if torrentInfo.name == "" {
+		torrentInfo.name = fmt.Sprintf("%x", magnet.InfoHash)
+	}
+
+	return torrentInfo
+}
+
+// NewTorrentInfoFromMetadata completes a magnet torrent with an info
+// dictionary fetched from peers. Trackers and peers from the magnet are kept
+func NewTorrentInfoFromMetadata(partial *TorrentInfo, rawInfoBytes string) (*TorrentInfo, error) {
+	if sha1.Sum([]byte(rawInfoBytes)) != partial.infoHash {
+		return nil, errors.New("metadata does not match info hash")
+	}
+
+	parser, err := NewParserFromData([]byte(rawInfoBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := parser.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+
+	root := Node{Value: map[string]Node{
+		"announce": {Value: partial.announce},
+		"info":     info,
+	}}
+
+	torrentInfo, err := NewTorrentInfoFromNode(root, rawInfoBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	torrentInfo.trackers = partial.trackers
+	torrentInfo.webSeeds = partial.webSeeds
+	torrentInfo.peers = partial.peers
+
 	return torrentInfo, nil
 }
 
@@ -109,6 +268,20 @@ func (ti *TorrentInfo) PieceCount() int {
 	return len(ti.pieces) / 20
 }
 
+// PieceSize returns the exact length of a piece. Every piece is PieceLength
+// long except the last one, which holds whatever is left
+func (ti *TorrentInfo) PieceSize(index int) int64 {
+	if index < 0 || index >= ti.PieceCount() {
+		return 0
+	}
+
+	if index == ti.PieceCount()-1 {
+		return ti.totalLength - int64(index)*ti.pieceLength
+	}
+
+	return ti.pieceLength
+}
+
 func (ti *TorrentInfo) Files() []FileInfo {
 	return ti.files
 }
@@ -0,0 +1,61 @@
+package torrent_test
+
+import (
+	"gotor/internal/testutil"
+	"gotor/internal/torrent"
+	"strings"
+	"testing"
+)
+
+func TestPieceSize(t *testing.T) {
+	const pieceLength = 32768
+
+	tests := []struct {
+		length int
+		sizes  []int64
+	}{
+		// not a multiple of the piece length
+		{100000, []int64{pieceLength, pieceLength, pieceLength, 1696}},
+		{pieceLength + 1, []int64{pieceLength, 1}},
+		{3 * pieceLength, []int64{pieceLength, pieceLength, pieceLength}},
+		{1, []int64{1}},
+	}
+
+	for _, tt := range tests {
+		count := len(tt.sizes)
+		ti := testutil.NewTorrentInfoFromDict(t, map[string]torrent.Node{
+			"name":         {Value: "test"},
+			"length":       {Value: tt.length},
+			"piece length": {Value: pieceLength},
+			"pieces":       {Value: strings.Repeat("h", 20*count)},
+		})
+
+		if ti.PieceCount() != count {
+			t.Fatalf("length %d: %d pieces, want %d", tt.length, ti.PieceCount(), count)
+		}
+		for i, want := range tt.sizes {
+			if got := ti.PieceSize(i); got != want {
+				t.Errorf("length %d: piece %d has size %d, want %d", tt.length, i, got, want)
+			}
+		}
+		if ti.PieceSize(-1) != 0 || ti.PieceSize(count) != 0 {
+			t.Errorf("length %d: pieces out of range have a size", tt.length)
+		}
+	}
+}
+
+func TestPieceSizeMultiFile(t *testing.T) {
+	ti := testutil.NewTorrentInfoFromDict(t, map[string]torrent.Node{
+		"name":         {Value: "test"},
+		"piece length": {Value: 16384},
+		"pieces":       {Value: strings.Repeat("h", 20*2)},
+		"files": {Value: []torrent.Node{
+			{Value: map[string]torrent.Node{"length": {Value: 10000}, "path": {Value: []torrent.Node{{Value: "a"}}}}},
+			{Value: map[string]torrent.Node{"length": {Value: 10000}, "path": {Value: []torrent.Node{{Value: "b"}}}}},
+		}},
+	})
+
+	if got := ti.PieceSize(1); got != 20000-16384 {
+		t.Fatalf("last piece has size %d, want %d", got, 20000-16384)
+	}
+}
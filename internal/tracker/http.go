@@ -0,0 +1,213 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"gotor/internal/torrent"
+	"gotor/internal/trackerproto"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// HTTPHandler serves /announce and /scrape in the original HTTP tracker
+// protocol, with compact (BEP 23, BEP 7) and dictionary peer lists
+type HTTPHandler struct {
+	registry    *Registry
+	interval    time.Duration
+	minInterval time.Duration
+}
+
+func NewHTTPHandler(registry *Registry, interval time.Duration) *HTTPHandler {
+	return &HTTPHandler{
+		registry:    registry,
+		interval:    interval,
+		minInterval: interval / 2,
+	}
+}
+
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/announce":
+		h.announce(w, r)
+	case "/scrape":
+		h.scrape(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *HTTPHandler) announce(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	infoHash, ok := parseInfoHash(query.Get("info_hash"))
+	if !ok {
+		writeFailure(w, "invalid info_hash")
+		return
+	}
+
+	peerId := query.Get("peer_id")
+	if len(peerId) != 20 {
+		writeFailure(w, "invalid peer_id")
+		return
+	}
+
+	port, err := strconv.ParseUint(query.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		writeFailure(w, "invalid port")
+		return
+	}
+
+	left, err := strconv.ParseInt(query.Get("left"), 10, 64)
+	if err != nil || left < 0 {
+		writeFailure(w, "invalid left")
+		return
+	}
+
+	// the ip parameter is ignored so nobody can announce someone else
+	ip, err := remoteAddr(r)
+	if err != nil {
+		writeFailure(w, "cannot determine address")
+		return
+	}
+
+	numWant := -1
+	if value := query.Get("numwant"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil {
+			numWant = n
+		}
+	}
+
+	result, err := h.registry.Announce(AnnounceRequest{
+		InfoHash: infoHash,
+		PeerId:   peerId,
+		Addr:     netip.AddrPortFrom(ip, uint16(port)),
+		Left:     left,
+		Event:    trackerproto.ParseEvent(query.Get("event")),
+		NumWant:  numWant,
+	})
+	if err != nil {
+		writeFailure(w, err.Error())
+		return
+	}
+
+	response := map[string]torrent.Node{
+		"interval":     {Value: int(h.interval.Seconds())},
+		"min interval": {Value: int(h.minInterval.Seconds())},
+		"complete":     {Value: result.Seeders},
+		"incomplete":   {Value: result.Leechers},
+	}
+
+	if query.Get("compact") == "0" {
+		response["peers"] = dictPeers(result.Peers, query.Get("no_peer_id") == "1")
+	} else {
+		peers, peers6 := compactPeers(result.Peers)
+		response["peers"] = torrent.Node{Value: string(peers)}
+		if len(peers6) > 0 {
+			response["peers6"] = torrent.Node{Value: string(peers6)}
+		}
+	}
+
+	writeNode(w, torrent.Node{Value: response})
+}
+
+func (h *HTTPHandler) scrape(w http.ResponseWriter, r *http.Request) {
+	var infoHashes [][20]byte
+	for _, value := range r.URL.Query()["info_hash"] {
+		infoHash, ok := parseInfoHash(value)
+		if !ok {
+			writeFailure(w, "invalid info_hash")
+			return
+		}
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	files := make(map[string]torrent.Node)
+	for hash, stats := range h.registry.Scrape(infoHashes) {
+		files[string(hash[:])] = torrent.Node{Value: map[string]torrent.Node{
+			"complete":   {Value: stats.Seeders},
+			"downloaded": {Value: stats.Completed},
+			"incomplete": {Value: stats.Leechers},
+		}}
+	}
+
+	writeNode(w, torrent.Node{Value: map[string]torrent.Node{
+		"files": {Value: files},
+	}})
+}
+
+func parseInfoHash(value string) ([20]byte, bool) {
+	if len(value) != 20 {
+		return [20]byte{}, false
+	}
+
+	return [20]byte([]byte(value)), true
+}
+
+func remoteAddr(r *http.Request) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	return ip.Unmap(), nil
+}
+
+// compactPeers packs peers into 6 byte IPv4 and 18 byte IPv6 entries
+func compactPeers(peers []PeerInfo) ([]byte, []byte) {
+	var peers4, peers6 []byte
+	for _, p := range peers {
+		entry := p.Addr.Addr().AsSlice()
+		entry = binary.BigEndian.AppendUint16(entry, p.Addr.Port())
+
+		if p.Addr.Addr().Is4() {
+			peers4 = append(peers4, entry...)
+		} else {
+			peers6 = append(peers6, entry...)
+		}
+	}
+
+	return peers4, peers6
+}
+
+func dictPeers(peers []PeerInfo, noPeerId bool) torrent.Node {
+	list := make([]torrent.Node, 0, len(peers))
+	for _, p := range peers {
+		dict := map[string]torrent.Node{
+			"ip":   {Value: p.Addr.Addr().String()},
+			"port": {Value: int(p.Addr.Port())},
+		}
+		if !noPeerId {
+			dict["peer id"] = torrent.Node{Value: p.PeerId}
+		}
+		list = append(list, torrent.Node{Value: dict})
+	}
+
+	return torrent.Node{Value: list}
+}
+
+// failures are sent with status 200, clients only look at the body
+func writeFailure(w http.ResponseWriter, reason string) {
+	writeNode(w, torrent.Node{Value: map[string]torrent.Node{
+		"failure reason": {Value: reason},
+	}})
+}
+
+func writeNode(w http.ResponseWriter, node torrent.Node) {
+	body, err := torrent.Encode(node)
+	if err != nil {
+		log.Printf("Tracker: encoding response: %v\n", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(body)
+}
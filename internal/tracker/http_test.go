@@ -0,0 +1,170 @@
+package tracker
+
+import (
+	"gotor/internal/torrent"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// get sends a request from addr to h and parses the bencoded response
+func get(t *testing.T, h *HTTPHandler, target string, addr string) map[string]torrent.Node {
+	t.Helper()
+
+	req := httptest.NewRequest("GET", target, nil)
+	req.RemoteAddr = addr
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	parser, err := torrent.NewParserFromData(rec.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("%v: %q", err, rec.Body.String())
+	}
+
+	return node.AsDict()
+}
+
+func announceUrl(peerId string, port string, values url.Values) string {
+	query := url.Values{
+		"info_hash": {string(testInfoHash[:])},
+		"peer_id":   {peerId},
+		"port":      {port},
+		"left":      {"100"},
+	}
+	for key, value := range values {
+		query[key] = value
+	}
+
+	return "/announce?" + query.Encode()
+}
+
+const (
+	testPeerId1 = "-GT0001-aaaaaaaaaaaa"
+	testPeerId2 = "-GT0001-bbbbbbbbbbbb"
+	testPeerId3 = "-GT0001-cccccccccccc"
+)
+
+func newTestHTTPHandler(t *testing.T) *HTTPHandler {
+	t.Helper()
+
+	h := NewHTTPHandler(NewRegistry(time.Hour), 30*time.Minute)
+	get(t, h, announceUrl(testPeerId1, "6881", nil), "10.0.0.1:50000")
+	get(t, h, announceUrl(testPeerId2, "6882", nil), "[2001:db8::2]:50000")
+
+	return h
+}
+
+func TestHTTPAnnounceCompact(t *testing.T) {
+	h := newTestHTTPHandler(t)
+
+	resp := get(t, h, announceUrl(testPeerId3, "6883", nil), "10.0.0.3:50000")
+	if reason, ok := resp["failure reason"]; ok {
+		t.Fatal(reason.AsString())
+	}
+
+	if got := resp["interval"].AsInt(); got != 1800 {
+		t.Errorf("interval %d, want 1800", got)
+	}
+	if got := resp["incomplete"].AsInt(); got != 3 {
+		t.Errorf("%d leechers, want 3", got)
+	}
+	if got := resp["peers"].AsString(); got != "\x0a\x00\x00\x01\x1a\xe1" {
+		t.Errorf("peers %x, want 10.0.0.1:6881", got)
+	}
+	want6 := "\x20\x01\x0d\xb8" + string(make([]byte, 11)) + "\x02\x1a\xe2"
+	if got := resp["peers6"].AsString(); got != want6 {
+		t.Errorf("peers6 %x, want [2001:db8::2]:6882", got)
+	}
+}
+
+func TestHTTPAnnounceDictionary(t *testing.T) {
+	h := newTestHTTPHandler(t)
+
+	resp := get(t, h, announceUrl(testPeerId3, "6883", url.Values{"compact": {"0"}}), "10.0.0.3:50000")
+	peers := resp["peers"].AsList()
+	if len(peers) != 2 {
+		t.Fatalf("got %d peers, want 2", len(peers))
+	}
+
+	found := make(map[string]map[string]torrent.Node)
+	for _, p := range peers {
+		dict := p.AsDict()
+		found[dict["ip"].AsString()] = dict
+	}
+	if p, ok := found["10.0.0.1"]; !ok || p["port"].AsInt() != 6881 || p["peer id"].AsString() != testPeerId1 {
+		t.Errorf("peer 10.0.0.1 is %v", p)
+	}
+	if p, ok := found["2001:db8::2"]; !ok || p["port"].AsInt() != 6882 {
+		t.Errorf("peer 2001:db8::2 is %v", p)
+	}
+
+	resp = get(t, h, announceUrl(testPeerId3, "6883", url.Values{"compact": {"0"}, "no_peer_id": {"1"}}), "10.0.0.3:50000")
+	for _, p := range resp["peers"].AsList() {
+		if _, ok := p.AsDict()["peer id"]; ok {
+			t.Error("sent a peer id despite no_peer_id")
+		}
+	}
+}
+
+func TestHTTPAnnounceIgnoresIpParameter(t *testing.T) {
+	h := NewHTTPHandler(NewRegistry(time.Hour), 30*time.Minute)
+
+	get(t, h, announceUrl(testPeerId1, "6881", url.Values{"ip": {"192.0.2.9"}}), "10.0.0.1:50000")
+	resp := get(t, h, announceUrl(testPeerId2, "6882", nil), "10.0.0.2:50000")
+	if got := resp["peers"].AsString(); got != "\x0a\x00\x00\x01\x1a\xe1" {
+		t.Errorf("peers %x, want the address the announce came from", got)
+	}
+}
+
+func TestHTTPAnnounceInvalid(t *testing.T) {
+	h := NewHTTPHandler(NewRegistry(time.Hour), 30*time.Minute)
+
+	for _, target := range []string{
+		announceUrl("short", "6881", nil),
+		announceUrl(testPeerId1, "0", nil),
+		announceUrl(testPeerId1, "70000", nil),
+		announceUrl(testPeerId1, "6881", url.Values{"left": {"-1"}}),
+		announceUrl(testPeerId1, "6881", url.Values{"info_hash": {"short"}}),
+	} {
+		if _, ok := get(t, h, target, "10.0.0.1:50000")["failure reason"]; !ok {
+			t.Errorf("%s: no failure reason", target)
+		}
+	}
+}
+
+func TestHTTPWhitelist(t *testing.T) {
+	registry := NewRegistry(time.Hour)
+	registry.SetWhitelist([][20]byte{{9}})
+	h := NewHTTPHandler(registry, 30*time.Minute)
+
+	resp := get(t, h, announceUrl(testPeerId1, "6881", nil), "10.0.0.1:50000")
+	if got := resp["failure reason"].AsString(); got != ErrNotWhitelisted.Error() {
+		t.Errorf("failure reason %q", got)
+	}
+}
+
+func TestHTTPScrape(t *testing.T) {
+	h := newTestHTTPHandler(t)
+	get(t, h, announceUrl(testPeerId3, "6883", url.Values{"left": {"0"}}), "10.0.0.3:50000")
+
+	query := url.Values{"info_hash": {string(testInfoHash[:]), string(make([]byte, 20))}}
+	files := get(t, h, "/scrape?"+query.Encode(), "10.0.0.1:50000")["files"].AsDict()
+	if len(files) != 1 {
+		t.Fatalf("scraped %d torrents, want 1", len(files))
+	}
+
+	stats := files[string(testInfoHash[:])].AsDict()
+	if stats["complete"].AsInt() != 1 || stats["incomplete"].AsInt() != 2 || stats["downloaded"].AsInt() != 0 {
+		t.Errorf("scrape %v", stats)
+	}
+
+	query = url.Values{"info_hash": {"short"}}
+	if _, ok := get(t, h, "/scrape?"+query.Encode(), "10.0.0.1:50000")["failure reason"]; !ok {
+		t.Error("no failure reason for an invalid info hash")
+	}
+}
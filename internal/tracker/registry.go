@@ -0,0 +1,218 @@
+package tracker
+
+import (
+	"errors"
+	"gotor/internal/trackerproto"
+	"math/rand"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	defaultNumWant = 50
+	maxNumWant     = 200
+)
+
+var ErrNotWhitelisted = errors.New("torrent is not tracked here")
+
+type AnnounceRequest struct {
+	InfoHash [20]byte
+	PeerId   string
+	Addr     netip.AddrPort
+	Left     int64
+	Event    trackerproto.Event
+	// negative means the default
+	NumWant int
+}
+
+type PeerInfo struct {
+	PeerId string
+	Addr   netip.AddrPort
+}
+
+type AnnounceResult struct {
+	Peers    []PeerInfo
+	Seeders  int
+	Leechers int
+}
+
+type ScrapeStats struct {
+	Seeders   int
+	Completed int
+	Leechers  int
+}
+
+type peerEntry struct {
+	addr     netip.AddrPort
+	left     int64
+	lastSeen time.Time
+}
+
+type swarm struct {
+	peers     map[string]*peerEntry
+	completed int
+}
+
+func (s *swarm) counts() (seeders int, leechers int) {
+	for _, p := range s.peers {
+		if p.left == 0 {
+			seeders++
+		} else {
+			leechers++
+		}
+	}
+
+	return seeders, leechers
+}
+
+// Registry keeps the swarms of every tracked torrent in memory. Peers that
+// don't announce again within PeerTimeout are dropped by Expire
+type Registry struct {
+	sync.Mutex
+	PeerTimeout time.Duration
+	swarms      map[[20]byte]*swarm
+	// nil tracks any torrent
+	whitelist map[[20]byte]struct{}
+}
+
+func NewRegistry(peerTimeout time.Duration) *Registry {
+	return &Registry{
+		PeerTimeout: peerTimeout,
+		swarms:      make(map[[20]byte]*swarm),
+	}
+}
+
+// SetWhitelist restricts the registry to the given info hashes, an empty
+// list lifts the restriction
+func (r *Registry) SetWhitelist(infoHashes [][20]byte) {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(infoHashes) == 0 {
+		r.whitelist = nil
+		return
+	}
+
+	r.whitelist = make(map[[20]byte]struct{}, len(infoHashes))
+	for _, hash := range infoHashes {
+		r.whitelist[hash] = struct{}{}
+	}
+}
+
+func (r *Registry) allowed(infoHash [20]byte) bool {
+	if r.whitelist == nil {
+		return true
+	}
+
+	_, ok := r.whitelist[infoHash]
+	return ok
+}
+
+func (r *Registry) Announce(req AnnounceRequest) (AnnounceResult, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if !r.allowed(req.InfoHash) {
+		return AnnounceResult{}, ErrNotWhitelisted
+	}
+
+	s, ok := r.swarms[req.InfoHash]
+	if !ok {
+		s = &swarm{peers: make(map[string]*peerEntry)}
+		r.swarms[req.InfoHash] = s
+	}
+
+	if req.Event == trackerproto.EventStopped {
+		delete(s.peers, req.PeerId)
+		seeders, leechers := s.counts()
+		return AnnounceResult{Seeders: seeders, Leechers: leechers}, nil
+	}
+
+	entry, known := s.peers[req.PeerId]
+	if !known {
+		entry = &peerEntry{}
+		s.peers[req.PeerId] = entry
+	}
+	// count a completion once, even if the client repeats the event
+	if req.Event == trackerproto.EventCompleted && (!known || entry.left != 0) {
+		s.completed++
+	}
+	entry.addr = req.Addr
+	entry.left = req.Left
+	entry.lastSeen = time.Now()
+
+	numWant := req.NumWant
+	if numWant < 0 {
+		numWant = defaultNumWant
+	}
+	numWant = min(numWant, maxNumWant)
+
+	var result AnnounceResult
+	result.Seeders, result.Leechers = s.counts()
+
+	candidates := make([]PeerInfo, 0, len(s.peers))
+	for peerId, p := range s.peers {
+		if peerId == req.PeerId {
+			continue
+		}
+		// seeders have no use for other seeders
+		if req.Left == 0 && p.left == 0 {
+			continue
+		}
+		candidates = append(candidates, PeerInfo{PeerId: peerId, Addr: p.addr})
+	}
+
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	result.Peers = candidates[:min(numWant, len(candidates))]
+
+	return result, nil
+}
+
+// Scrape returns the stats of the requested torrents, or of every torrent
+// when none are given. Unknown torrents are left out
+func (r *Registry) Scrape(infoHashes [][20]byte) map[[20]byte]ScrapeStats {
+	r.Lock()
+	defer r.Unlock()
+
+	stats := make(map[[20]byte]ScrapeStats)
+	add := func(hash [20]byte, s *swarm) {
+		seeders, leechers := s.counts()
+		stats[hash] = ScrapeStats{Seeders: seeders, Completed: s.completed, Leechers: leechers}
+	}
+
+	if len(infoHashes) == 0 {
+		for hash, s := range r.swarms {
+			add(hash, s)
+		}
+		return stats
+	}
+
+	for _, hash := range infoHashes {
+		if s, ok := r.swarms[hash]; ok && r.allowed(hash) {
+			add(hash, s)
+		}
+	}
+
+	return stats
+}
+
+// Expire drops peers that stopped announcing and swarms left empty
+func (r *Registry) Expire() {
+	r.Lock()
+	defer r.Unlock()
+
+	deadline := time.Now().Add(-r.PeerTimeout)
+	for hash, s := range r.swarms {
+		for peerId, p := range s.peers {
+			if p.lastSeen.Before(deadline) {
+				delete(s.peers, peerId)
+			}
+		}
+		if len(s.peers) == 0 && s.completed == 0 {
+			delete(r.swarms, hash)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package tracker
+
+import (
+	"errors"
+	"fmt"
+	"gotor/internal/trackerproto"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testInfoHash = [20]byte{1, 2, 3}
+
+// testAnnounce builds the announce of peer number n
+func testAnnounce(n int, left int64) AnnounceRequest {
+	return AnnounceRequest{
+		InfoHash: testInfoHash,
+		PeerId:   fmt.Sprintf("peer-%s%02d", strings.Repeat("x", 13), n),
+		Addr:     netip.MustParseAddrPort(fmt.Sprintf("10.0.0.%d:6881", n)),
+		Left:     left,
+		NumWant:  -1,
+	}
+}
+
+func TestRegistryAnnounce(t *testing.T) {
+	r := NewRegistry(time.Hour)
+
+	if _, err := r.Announce(testAnnounce(1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Announce(testAnnounce(2, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := r.Announce(testAnnounce(3, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Seeders != 1 || result.Leechers != 2 {
+		t.Errorf("%d seeders and %d leechers, want 1 and 2", result.Seeders, result.Leechers)
+	}
+	if len(result.Peers) != 2 {
+		t.Fatalf("got %d peers, want the 2 others", len(result.Peers))
+	}
+	for _, p := range result.Peers {
+		if p.PeerId == testAnnounce(3, 0).PeerId {
+			t.Error("peer got itself back")
+		}
+	}
+
+	// a seeder only hears about leechers
+	result, err = r.Announce(testAnnounce(4, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range result.Peers {
+		if p.PeerId == testAnnounce(1, 0).PeerId {
+			t.Error("seeder got another seeder")
+		}
+	}
+	if len(result.Peers) != 2 {
+		t.Errorf("got %d peers, want the 2 leechers", len(result.Peers))
+	}
+}
+
+func TestRegistryNumWant(t *testing.T) {
+	r := NewRegistry(time.Hour)
+	for n := 1; n <= 10; n++ {
+		if _, err := r.Announce(testAnnounce(n, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := testAnnounce(11, 100)
+	req.NumWant = 3
+	result, err := r.Announce(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Peers) != 3 {
+		t.Errorf("got %d peers, want 3", len(result.Peers))
+	}
+}
+
+func TestRegistryStoppedAndCompleted(t *testing.T) {
+	r := NewRegistry(time.Hour)
+
+	if _, err := r.Announce(testAnnounce(1, 100)); err != nil {
+		t.Fatal(err)
+	}
+	// completed is counted once however often it is repeated
+	for range 2 {
+		req := testAnnounce(1, 0)
+		req.Event = trackerproto.EventCompleted
+		if _, err := r.Announce(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stopped := testAnnounce(1, 0)
+	stopped.Event = trackerproto.EventStopped
+	result, err := r.Announce(stopped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Seeders != 0 || result.Leechers != 0 {
+		t.Errorf("stopped peer still counted: %+v", result)
+	}
+
+	stats := r.Scrape([][20]byte{testInfoHash})[testInfoHash]
+	if stats != (ScrapeStats{Completed: 1}) {
+		t.Errorf("scrape %+v, want one completion and no peers", stats)
+	}
+}
+
+func TestRegistryScrape(t *testing.T) {
+	r := NewRegistry(time.Hour)
+
+	other := [20]byte{9}
+	for n, left := range []int64{0, 0, 100} {
+		if _, err := r.Announce(testAnnounce(n+1, left)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := testAnnounce(4, 100)
+	req.InfoHash = other
+	if _, err := r.Announce(req); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := r.Scrape([][20]byte{testInfoHash, {7}})
+	if len(stats) != 1 {
+		t.Fatalf("scraped %d torrents, want only the known one", len(stats))
+	}
+	if got := stats[testInfoHash]; got.Seeders != 2 || got.Leechers != 1 {
+		t.Errorf("scrape %+v, want 2 seeders and 1 leecher", got)
+	}
+
+	if all := r.Scrape(nil); len(all) != 2 {
+		t.Errorf("full scrape has %d torrents, want 2", len(all))
+	}
+}
+
+func TestRegistryWhitelist(t *testing.T) {
+	r := NewRegistry(time.Hour)
+	r.SetWhitelist([][20]byte{testInfoHash})
+
+	if _, err := r.Announce(testAnnounce(1, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	req := testAnnounce(2, 100)
+	req.InfoHash = [20]byte{9}
+	if _, err := r.Announce(req); !errors.Is(err, ErrNotWhitelisted) {
+		t.Errorf("announce of an unlisted torrent: %v", err)
+	}
+	if stats := r.Scrape([][20]byte{{9}}); len(stats) != 0 {
+		t.Errorf("scraped an unlisted torrent: %v", stats)
+	}
+
+	// an empty list tracks anything again
+	r.SetWhitelist(nil)
+	if _, err := r.Announce(req); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRegistryExpire(t *testing.T) {
+	r := NewRegistry(time.Minute)
+
+	if _, err := r.Announce(testAnnounce(1, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Announce(testAnnounce(2, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	r.Lock()
+	r.swarms[testInfoHash].peers[testAnnounce(1, 0).PeerId].lastSeen = time.Now().Add(-2 * time.Minute)
+	r.Unlock()
+
+	r.Expire()
+	result, err := r.Announce(testAnnounce(3, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Peers) != 1 || result.Peers[0].PeerId != testAnnounce(2, 0).PeerId {
+		t.Errorf("peers %+v, want only the one that announced in time", result.Peers)
+	}
+
+	// swarms without peers and completions go away
+	r.Lock()
+	for _, p := range r.swarms[testInfoHash].peers {
+		p.lastSeen = time.Time{}
+	}
+	r.Unlock()
+	r.Expire()
+	if stats := r.Scrape(nil); len(stats) != 0 {
+		t.Errorf("expired swarm still scraped: %v", stats)
+	}
+}
@@ -0,0 +1,123 @@
+package tracker
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	// HTTPAddr is where /announce and /scrape are served, e.g. ":6969"
+	HTTPAddr string
+	// UDPAddr enables the UDP protocol when set
+	UDPAddr string
+	// Interval is how often clients are asked to announce
+	Interval time.Duration
+	// PeerTimeout drops peers that did not announce for this long
+	PeerTimeout time.Duration
+	// Whitelist limits the tracker to these torrents, empty tracks anything
+	Whitelist [][20]byte
+}
+
+func DefaultConfig() Config {
+	return Config{
+		HTTPAddr:    ":6969",
+		Interval:    30 * time.Minute,
+		PeerTimeout: 45 * time.Minute,
+	}
+}
+
+// Server hosts a tracker over HTTP and optionally UDP
+type Server struct {
+	sync.Mutex
+	config    Config
+	registry  *Registry
+	http      *http.Server
+	udp       *UDPServer
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewServer(config Config) *Server {
+	registry := NewRegistry(config.PeerTimeout)
+	registry.SetWhitelist(config.Whitelist)
+
+	return &Server{
+		config:   config,
+		registry: registry,
+		http: &http.Server{
+			Handler:           NewHTTPHandler(registry, config.Interval),
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+		done: make(chan struct{}),
+	}
+}
+
+func (s *Server) Registry() *Registry {
+	return s.registry
+}
+
+// ListenAndServe binds the configured addresses and serves until Close
+func (s *Server) ListenAndServe() error {
+	httpListener, err := net.Listen("tcp", s.config.HTTPAddr)
+	if err != nil {
+		return err
+	}
+
+	if s.config.UDPAddr != "" {
+		udp, err := ListenUDP(s.config.UDPAddr, s.registry, s.config.Interval)
+		if err != nil {
+			httpListener.Close()
+			return err
+		}
+
+		s.Lock()
+		s.udp = udp
+		s.Unlock()
+
+		go func() {
+			if err := udp.Serve(); err != nil {
+				log.Printf("Tracker: udp stopped: %v\n", err)
+			}
+		}()
+	}
+
+	go s.expire()
+
+	log.Printf("Tracker listening on %s\n", httpListener.Addr())
+	if err := s.http.Serve(httpListener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *Server) expire() {
+	ticker := time.NewTicker(max(s.config.PeerTimeout/4, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.registry.Expire()
+		}
+	}
+}
+
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.http.Close()
+
+		s.Lock()
+		defer s.Unlock()
+		if s.udp != nil {
+			s.udp.Close()
+		}
+	})
+}
@@ -0,0 +1,39 @@
+package tracker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServerExpiresPeers(t *testing.T) {
+	config := DefaultConfig()
+	config.HTTPAddr = "127.0.0.1:0"
+	config.UDPAddr = "127.0.0.1:0"
+	config.PeerTimeout = 100 * time.Millisecond
+
+	s := NewServer(config)
+	served := make(chan error, 1)
+	go func() { served <- s.ListenAndServe() }()
+
+	if _, err := s.Registry().Announce(testAnnounce(1, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.Registry().Scrape(nil)) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("peer never expired")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	s.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe kept running after Close")
+	}
+}
@@ -0,0 +1,209 @@
+package tracker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"gotor/internal/trackerproto"
+	"log"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// connection ids are derived from the client address and the current
+// minute, so an id stays valid for one to two minutes without keeping state
+const connectionIdWindow = time.Minute
+
+// UDPServer answers the UDP tracker protocol (BEP 15)
+type UDPServer struct {
+	registry *Registry
+	interval time.Duration
+	conn     *net.UDPConn
+	secret   []byte
+}
+
+func ListenUDP(addr string, registry *Registry, interval time.Duration) (*UDPServer, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &UDPServer{
+		registry: registry,
+		interval: interval,
+		conn:     conn,
+		secret:   secret,
+	}, nil
+}
+
+func (us *UDPServer) Addr() net.Addr {
+	return us.conn.LocalAddr()
+}
+
+// Serve handles packets until the server is closed
+func (us *UDPServer) Serve() error {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := us.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+		if resp := us.handle(buf[:n], addr); resp != nil {
+			if _, err := us.conn.WriteToUDPAddrPort(resp, addr); err != nil {
+				log.Printf("Tracker: udp reply to %s: %v\n", addr, err)
+			}
+		}
+	}
+}
+
+func (us *UDPServer) Close() error {
+	return us.conn.Close()
+}
+
+func (us *UDPServer) handle(packet []byte, addr netip.AddrPort) []byte {
+	if len(packet) < 16 {
+		return nil
+	}
+
+	connectionId := binary.BigEndian.Uint64(packet[0:8])
+	action := binary.BigEndian.Uint32(packet[8:12])
+	transactionId := binary.BigEndian.Uint32(packet[12:16])
+
+	if action == trackerproto.UDPActionConnect {
+		if connectionId != trackerproto.UDPProtocolId {
+			return nil
+		}
+
+		resp := make([]byte, 16)
+		binary.BigEndian.PutUint32(resp[0:4], trackerproto.UDPActionConnect)
+		binary.BigEndian.PutUint32(resp[4:8], transactionId)
+		binary.BigEndian.PutUint64(resp[8:16], us.connectionId(addr, time.Now()))
+		return resp
+	}
+
+	if !us.validConnectionId(connectionId, addr) {
+		return udpError(transactionId, "invalid connection id")
+	}
+
+	switch action {
+	case trackerproto.UDPActionAnnounce:
+		return us.announce(packet, addr, transactionId)
+	case trackerproto.UDPActionScrape:
+		return us.scrape(packet, transactionId)
+	default:
+		return udpError(transactionId, "unknown action")
+	}
+}
+
+func (us *UDPServer) announce(packet []byte, addr netip.AddrPort, transactionId uint32) []byte {
+	if len(packet) < 98 {
+		return udpError(transactionId, "announce request too short")
+	}
+
+	var infoHash [20]byte
+	copy(infoHash[:], packet[16:36])
+
+	left := int64(binary.BigEndian.Uint64(packet[64:72]))
+	if left < 0 {
+		return udpError(transactionId, "invalid left")
+	}
+
+	port := binary.BigEndian.Uint16(packet[96:98])
+	if port == 0 {
+		return udpError(transactionId, "invalid port")
+	}
+
+	result, err := us.registry.Announce(AnnounceRequest{
+		InfoHash: infoHash,
+		PeerId:   string(packet[36:56]),
+		Addr:     netip.AddrPortFrom(addr.Addr(), port),
+		Left:     left,
+		Event:    trackerproto.Event(binary.BigEndian.Uint32(packet[80:84])),
+		NumWant:  int(int32(binary.BigEndian.Uint32(packet[92:96]))),
+	})
+	if err != nil {
+		return udpError(transactionId, err.Error())
+	}
+
+	resp := make([]byte, 20)
+	binary.BigEndian.PutUint32(resp[0:4], trackerproto.UDPActionAnnounce)
+	binary.BigEndian.PutUint32(resp[4:8], transactionId)
+	binary.BigEndian.PutUint32(resp[8:12], uint32(us.interval.Seconds()))
+	binary.BigEndian.PutUint32(resp[12:16], uint32(result.Leechers))
+	binary.BigEndian.PutUint32(resp[16:20], uint32(result.Seeders))
+
+	// the peer list has the address family the request came in over
+	peers4, peers6 := compactPeers(result.Peers)
+	if addr.Addr().Is4() {
+		resp = append(resp, peers4...)
+	} else {
+		resp = append(resp, peers6...)
+	}
+
+	return resp
+}
+
+func (us *UDPServer) scrape(packet []byte, transactionId uint32) []byte {
+	count := (len(packet) - 16) / 20
+	if count == 0 || count > trackerproto.MaxScrapeHashes {
+		return udpError(transactionId, "invalid number of info hashes")
+	}
+
+	infoHashes := make([][20]byte, count)
+	for i := range infoHashes {
+		copy(infoHashes[i][:], packet[16+20*i:])
+	}
+
+	stats := us.registry.Scrape(infoHashes)
+
+	resp := make([]byte, 8, 8+12*count)
+	binary.BigEndian.PutUint32(resp[0:4], trackerproto.UDPActionScrape)
+	binary.BigEndian.PutUint32(resp[4:8], transactionId)
+	for _, hash := range infoHashes {
+		s := stats[hash]
+		resp = binary.BigEndian.AppendUint32(resp, uint32(s.Seeders))
+		resp = binary.BigEndian.AppendUint32(resp, uint32(s.Completed))
+		resp = binary.BigEndian.AppendUint32(resp, uint32(s.Leechers))
+	}
+
+	return resp
+}
+
+func (us *UDPServer) connectionId(addr netip.AddrPort, now time.Time) uint64 {
+	mac := hmac.New(sha256.New, us.secret)
+	mac.Write(addr.Addr().AsSlice())
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(now.Unix()/int64(connectionIdWindow.Seconds()))))
+
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+func (us *UDPServer) validConnectionId(id uint64, addr netip.AddrPort) bool {
+	now := time.Now()
+	return id == us.connectionId(addr, now) || id == us.connectionId(addr, now.Add(-connectionIdWindow))
+}
+
+func udpError(transactionId uint32, message string) []byte {
+	resp := make([]byte, 8, 8+len(message))
+	binary.BigEndian.PutUint32(resp[0:4], trackerproto.UDPActionError)
+	binary.BigEndian.PutUint32(resp[4:8], transactionId)
+	return append(resp, message...)
+}
@@ -0,0 +1,182 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"gotor/internal/trackerproto"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func newTestUDPServer(t *testing.T, registry *Registry) *UDPServer {
+	t.Helper()
+
+	us, err := ListenUDP("127.0.0.1:0", registry, 30*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { us.Close() })
+
+	return us
+}
+
+// udpConnect returns the connection id us hands out to addr
+func udpConnect(t *testing.T, us *UDPServer, addr netip.AddrPort) uint64 {
+	t.Helper()
+
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], trackerproto.UDPProtocolId)
+	binary.BigEndian.PutUint32(req[8:12], trackerproto.UDPActionConnect)
+	binary.BigEndian.PutUint32(req[12:16], 7)
+
+	resp := us.handle(req, addr)
+	if len(resp) != 16 || binary.BigEndian.Uint32(resp[0:4]) != trackerproto.UDPActionConnect || binary.BigEndian.Uint32(resp[4:8]) != 7 {
+		t.Fatalf("connect response %x", resp)
+	}
+
+	return binary.BigEndian.Uint64(resp[8:16])
+}
+
+func udpAnnounceRequest(connectionId uint64, peerId string, left int64, port uint16) []byte {
+	req := make([]byte, 98)
+	binary.BigEndian.PutUint64(req[0:8], connectionId)
+	binary.BigEndian.PutUint32(req[8:12], trackerproto.UDPActionAnnounce)
+	binary.BigEndian.PutUint32(req[12:16], 8)
+	copy(req[16:36], testInfoHash[:])
+	copy(req[36:56], peerId)
+	binary.BigEndian.PutUint64(req[64:72], uint64(left))
+	binary.BigEndian.PutUint32(req[92:96], 0xffffffff)
+	binary.BigEndian.PutUint16(req[96:98], port)
+	return req
+}
+
+func udpErrorMessage(resp []byte) (string, bool) {
+	if len(resp) < 8 || binary.BigEndian.Uint32(resp[0:4]) != trackerproto.UDPActionError {
+		return "", false
+	}
+	return string(resp[8:]), true
+}
+
+func TestUDPConnectRequiresProtocolId(t *testing.T) {
+	us := newTestUDPServer(t, NewRegistry(time.Hour))
+
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], 1234)
+	if resp := us.handle(req, netip.MustParseAddrPort("10.0.0.1:6881")); resp != nil {
+		t.Errorf("answered a connect without the protocol id: %x", resp)
+	}
+}
+
+func TestUDPConnectionId(t *testing.T) {
+	us := newTestUDPServer(t, NewRegistry(time.Hour))
+	addr := netip.MustParseAddrPort("10.0.0.1:6881")
+	id := udpConnect(t, us, addr)
+
+	if !us.validConnectionId(id, addr) {
+		t.Error("fresh connection id rejected")
+	}
+	// the port may change, the address may not
+	if !us.validConnectionId(id, netip.MustParseAddrPort("10.0.0.1:7000")) {
+		t.Error("connection id rejected from another port")
+	}
+	if us.validConnectionId(id, netip.MustParseAddrPort("10.0.0.2:6881")) {
+		t.Error("connection id accepted from another address")
+	}
+
+	// ids of the previous window are still good, older ones are not
+	now := time.Now()
+	if !us.validConnectionId(us.connectionId(addr, now.Add(-connectionIdWindow)), addr) {
+		t.Error("connection id of the previous window rejected")
+	}
+	if us.validConnectionId(us.connectionId(addr, now.Add(-3*connectionIdWindow)), addr) {
+		t.Error("expired connection id accepted")
+	}
+
+	resp := us.handle(udpAnnounceRequest(id+1, testPeerId1, 100, 6881), addr)
+	if msg, ok := udpErrorMessage(resp); !ok || msg != "invalid connection id" {
+		t.Errorf("announce with a wrong connection id got %q", resp)
+	}
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	us := newTestUDPServer(t, NewRegistry(time.Hour))
+
+	first := netip.MustParseAddrPort("10.0.0.1:50000")
+	resp := us.handle(udpAnnounceRequest(udpConnect(t, us, first), testPeerId1, 0, 6881), first)
+	if msg, ok := udpErrorMessage(resp); ok {
+		t.Fatal(msg)
+	}
+
+	second := netip.MustParseAddrPort("10.0.0.2:50000")
+	resp = us.handle(udpAnnounceRequest(udpConnect(t, us, second), testPeerId2, 100, 6882), second)
+	if msg, ok := udpErrorMessage(resp); ok {
+		t.Fatal(msg)
+	}
+
+	if len(resp) != 26 {
+		t.Fatalf("response of %d bytes, want one peer", len(resp))
+	}
+	if got := binary.BigEndian.Uint32(resp[0:4]); got != trackerproto.UDPActionAnnounce {
+		t.Errorf("action %d", got)
+	}
+	if got := binary.BigEndian.Uint32(resp[8:12]); got != 1800 {
+		t.Errorf("interval %d, want 1800", got)
+	}
+	leechers, seeders := binary.BigEndian.Uint32(resp[12:16]), binary.BigEndian.Uint32(resp[16:20])
+	if leechers != 1 || seeders != 1 {
+		t.Errorf("%d leechers and %d seeders, want 1 and 1", leechers, seeders)
+	}
+	if got := string(resp[20:]); got != "\x0a\x00\x00\x01\x1a\xe1" {
+		t.Errorf("peers %x, want 10.0.0.1:6881", got)
+	}
+}
+
+func TestUDPAnnounceWhitelist(t *testing.T) {
+	registry := NewRegistry(time.Hour)
+	registry.SetWhitelist([][20]byte{{9}})
+	us := newTestUDPServer(t, registry)
+
+	addr := netip.MustParseAddrPort("10.0.0.1:50000")
+	resp := us.handle(udpAnnounceRequest(udpConnect(t, us, addr), testPeerId1, 0, 6881), addr)
+	if msg, ok := udpErrorMessage(resp); !ok || msg != ErrNotWhitelisted.Error() {
+		t.Errorf("announce of an unlisted torrent got %q", resp)
+	}
+}
+
+func TestUDPScrape(t *testing.T) {
+	us := newTestUDPServer(t, NewRegistry(time.Hour))
+	addr := netip.MustParseAddrPort("10.0.0.1:50000")
+	id := udpConnect(t, us, addr)
+	us.handle(udpAnnounceRequest(id, testPeerId1, 0, 6881), addr)
+
+	scrape := func(hashes ...[20]byte) []byte {
+		req := make([]byte, 16, 16+20*len(hashes))
+		binary.BigEndian.PutUint64(req[0:8], id)
+		binary.BigEndian.PutUint32(req[8:12], trackerproto.UDPActionScrape)
+		for _, hash := range hashes {
+			req = append(req, hash[:]...)
+		}
+		return us.handle(req, addr)
+	}
+
+	resp := scrape(testInfoHash, [20]byte{7})
+	if len(resp) != 8+2*12 {
+		t.Fatalf("response of %d bytes, want two entries", len(resp))
+	}
+	if seeders := binary.BigEndian.Uint32(resp[8:12]); seeders != 1 {
+		t.Errorf("%d seeders, want 1", seeders)
+	}
+	// unknown torrents are reported as empty
+	for i := 20; i < len(resp); i++ {
+		if resp[i] != 0 {
+			t.Fatalf("unknown torrent has stats %x", resp[20:])
+		}
+	}
+
+	if _, ok := udpErrorMessage(scrape()); !ok {
+		t.Error("scrape without info hashes accepted")
+	}
+	if _, ok := udpErrorMessage(scrape(make([][20]byte, trackerproto.MaxScrapeHashes+1)...)); !ok {
+		t.Error("scrape beyond the hash limit accepted")
+	}
+}
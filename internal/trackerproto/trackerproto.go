@@ -0,0 +1,55 @@
+package trackerproto
+
+// Event is the event of an announce, shared by the tracker clients and the
+// tracker server
+type Event byte
+
+// values match the event field of the UDP protocol
+const (
+	EventNone Event = iota
+	EventCompleted
+	EventStarted
+	EventStopped
+)
+
+func (e Event) String() string {
+	switch e {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	default:
+		return ""
+	}
+}
+
+// ParseEvent reads the event parameter of an HTTP announce
+func ParseEvent(name string) Event {
+	switch name {
+	case "completed":
+		return EventCompleted
+	case "started":
+		return EventStarted
+	case "stopped":
+		return EventStopped
+	default:
+		return EventNone
+	}
+}
+
+// UDPProtocolId opens every connect request of the UDP tracker protocol
+// (BEP 15)
+const UDPProtocolId = 0x41727101980
+
+// actions of the UDP tracker protocol
+const (
+	UDPActionConnect  = 0
+	UDPActionAnnounce = 1
+	UDPActionScrape   = 2
+	UDPActionError    = 3
+)
+
+// BEP 15 allows up to 74 info hashes in one scrape
+const MaxScrapeHashes = 74
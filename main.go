@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/AllenDang/cimgui-go/imgui"
@@ -8,25 +10,47 @@ import (
 	"gotor/internal/network"
 	"gotor/internal/storage"
 	"gotor/internal/torrent"
+	"gotor/internal/tracker"
+	"gotor/internal/trackerproto"
 	"gotor/pkg"
 	"log"
-	url2 "net/url"
 	"os"
 	"os/signal"
-	"strconv"
+	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 )
 
+const (
+	dhtBootstrapWait = 30 * time.Second
+	metadataTimeout  = 5 * time.Minute
+)
+
 type App struct {
 	sync.Mutex
-	torrentInfo   *torrent.TorrentInfo
-	pieceManager  *storage.PieceManager
-	fileManager   *storage.FileManager
-	status        string
-	ready         bool
-	isDownloading bool
+	torrentInfo    *torrent.TorrentInfo
+	pieceManager   *storage.PieceManager
+	fileManager    *storage.FileManager
+	listener       *network.PeerListener
+	swarm          *network.Swarm
+	trackers       *network.TrackerManager
+	announcer      *network.Announcer
+	dht            *network.DHT
+	dhtStatePath   string
+	lsd            *network.LSD
+	announceAll    bool
+	trackerConfig  network.TrackerClientConfig
+	udpRetransmits int
+	port           int
+	uploadSlots    int
+	connLimiter    *network.ConnLimiter
+	snubTimeout    time.Duration
+	strategy       storage.PickStrategy
+	status         string
+	ready          bool
+	isDownloading  bool
 }
 
 func (a *App) setStatus(status string) {
@@ -36,115 +60,448 @@ func (a *App) setStatus(status string) {
 }
 
 func (a *App) Close() {
+	// stopping the announcer waits on the trackers, the UI reading the
+	// status must not block on the lock meanwhile
+	a.Lock()
+	announcer := a.announcer
+	a.Unlock()
+	if announcer != nil {
+		announcer.Stop()
+	}
+
 	a.Lock()
 	defer a.Unlock()
+	if a.listener != nil {
+		a.listener.Close()
+	}
+	if a.dht != nil {
+		if a.dhtStatePath != "" {
+			if err := a.dht.SaveState(a.dhtStatePath); err != nil {
+				log.Printf("Saving DHT state: %v\n", err)
+			}
+		}
+		a.dht.Close()
+	}
+	if a.lsd != nil {
+		a.lsd.Close()
+	}
+	if a.swarm != nil {
+		a.swarm.Close()
+	}
 	if a.fileManager != nil {
 		a.fileManager.Close()
 	}
 }
 
-func (a *App) startDownload(torrentPath string, saveDir string) {
-	a.setStatus("Initializing")
+func (a *App) loadTorrent(input string) (*torrent.TorrentInfo, error) {
+	if torrent.IsMagnet(input) {
+		a.setStatus("Parsing magnet link")
 
-	defer func() {
-		if err := recover(); err != nil {
-			log.Println(err)
-			a.setStatus(fmt.Sprintf("Fatal error: %v", err))
+		magnet, err := torrent.ParseMagnet(input)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing magnet link: %w", err)
 		}
-	}()
+
+		return torrent.NewTorrentInfoFromMagnet(magnet), nil
+	}
 
 	a.setStatus("Parsing torrent")
 
-	parser, err := torrent.NewParserFromFile(torrentPath)
+	parser, err := torrent.NewParserFromFile(input)
 	if err != nil {
-		a.setStatus("Error creating a parser: " + err.Error())
-		return
+		return nil, fmt.Errorf("error creating a parser: %w", err)
 	}
 
 	root, err := parser.Parse()
 	if err != nil {
-		a.setStatus("Error parsing torrent: " + err.Error())
-		return
+		return nil, fmt.Errorf("error parsing torrent: %w", err)
 	}
 
-	a.torrentInfo, err = torrent.NewTorrentInfoFromNode(root, parser.InfoRaw())
+	torrentInfo, err := torrent.NewTorrentInfoFromNode(root, parser.InfoRaw())
 	if err != nil {
-		a.setStatus("Error creating torrent info: " + err.Error())
-		return
+		return nil, fmt.Errorf("error creating torrent info: %w", err)
 	}
 
-	files := a.torrentInfo.Files()
-	log.Printf("DEBUG: Found %d files in torrent\n", len(files))
-	for _, f := range files {
-		log.Printf("DEBUG: File=%s, Size=%d, StartOffset=%d\n", f.Path, f.Length, f.StartOffset)
+	return torrentInfo, nil
+}
+
+// findPeers collects the direct peers of a magnet link, announces the
+// started event and falls back to the DHT when nothing else gave peers. The
+// tracker response is nil when no tracker answered
+func (a *App) findPeers(peerId string) ([]network.Peer, *network.AnnounceResponse, error) {
+	var peers []network.Peer
+
+	for _, addr := range a.torrentInfo.Peers() {
+		peer, err := network.ParsePeer(addr)
+		if err != nil {
+			log.Printf("Skipping peer %s: %v\n", addr, err)
+			continue
+		}
+		peers = append(peers, peer)
 	}
 
-	a.fileManager = storage.NewFileManager(*a.torrentInfo, saveDir)
-	a.pieceManager = storage.NewPieceManager(a.torrentInfo.PieceCount())
+	trackers := network.NewTrackerManager(a.torrentInfo.Tiers())
+	trackers.Parallel = a.announceAll
+	trackers.HTTPConfig = a.trackerConfig
+	trackers.UDPMaxRetransmits = a.udpRetransmits
+	a.trackers = trackers
+
+	var resp *network.AnnounceResponse
+	var trackerErr error
+	if !trackers.Empty() {
+		a.setStatus("Contacting trackers")
+
+		// the size is unknown until metadata arrives, but trackers tend to hide
+		// seeders from peers that report nothing left
+		left := a.torrentInfo.TotalLength()
+		if !a.torrentInfo.HasMetadata() {
+			left = 16 * 1024
+		}
 
-	a.ready = true
+		resp, trackerErr = trackers.Announce(network.AnnounceParams{
+			InfoHash: a.torrentInfo.InfoHash(),
+			PeerId:   peerId,
+			Port:     a.port,
+			Left:     left,
+			Event:    trackerproto.EventStarted,
+			NumWant:  -1,
+		})
+		if trackerErr != nil {
+			log.Printf("No tracker answered: %v\n", trackerErr)
+		} else {
+			peers = append(peers, resp.Peers...)
+		}
+	}
 
-	a.setStatus("Contacting tracker " + a.torrentInfo.Announce())
+	// a magnet link does not tell whether the torrent is private (BEP 27),
+	// so without trackers or direct peers the DHT is the only way to its
+	// metadata. Once that is known the swarm keeps private torrents off the
+	// DHT, peer exchange and LSD
+	if len(peers) == 0 && a.dht != nil && !a.torrentInfo.Private() {
+		a.setStatus("Looking up peers in the DHT")
 
-	peerId := pkg.GeneratePeerId()
-	u, err := pkg.ParseTrackerUrl(a.torrentInfo.Announce())
-	if err != nil {
-		a.setStatus("Error parsing tracker url: " + err.Error())
-		return
+		dhtPeers, err := a.dhtPeers()
+		if err != nil {
+			log.Printf("DHT lookup failed: %v\n", err)
+		}
+		peers = append(peers, dhtPeers...)
 	}
 
-	infoHash := a.torrentInfo.InfoHash()
+	if len(peers) == 0 {
+		if trackerErr != nil {
+			return nil, nil, fmt.Errorf("error getting response from tracker: %w", trackerErr)
+		}
+		return nil, nil, errors.New("no tracker and no peers to connect to")
+	}
 
-	params := url2.Values{}
-	params.Add("info_hash", string(infoHash[:]))
-	params.Add("peer_id", peerId)
-	params.Add("port", "42069")
-	params.Add("uploaded", "0")
-	params.Add("downloaded", "0")
-	params.Add("left", strconv.FormatInt(a.torrentInfo.TotalLength(), 10))
-	params.Add("compact", "1")
+	return peers, resp, nil
+}
 
-	fullPath := u.Path + "?" + params.Encode()
+// dhtPeers looks up peers once the DHT knows some nodes
+func (a *App) dhtPeers() ([]network.Peer, error) {
+	a.waitForDHT()
 
-	client := network.NewTrackerClient()
+	return a.dht.GetPeers(a.torrentInfo.InfoHash())
+}
+
+// waitForDHT gives a freshly started DHT some time to bootstrap
+func (a *App) waitForDHT() {
+	deadline := time.Now().Add(dhtBootstrapWait)
+	for a.dht.NodeCount() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+	}
+}
 
-	rawResponse, err := client.Request(u.Host, fullPath, u.Port)
+// announceDHT announces the torrent to the DHT once it bootstrapped
+func (a *App) announceDHT(swarm *network.Swarm) {
+	a.waitForDHT()
+	swarm.RunDHT(a.dht, a.port)
+}
+
+func (a *App) fetchMetadata(peers []network.Peer, peerId string) (*torrent.TorrentInfo, error) {
+	raw, err := network.FetchMetadata(*a.torrentInfo, peerId, peers, a.connLimiter, metadataTimeout)
 	if err != nil {
-		a.setStatus("Error getting response from tracker: " + err.Error())
+		return nil, err
+	}
+
+	return torrent.NewTorrentInfoFromMetadata(a.torrentInfo, raw)
+}
+
+func (a *App) startDownload(input string, saveDir string) {
+	a.setStatus("Initializing")
+
+	defer func() {
+		if err := recover(); err != nil {
+			log.Println(err)
+			a.setStatus(fmt.Sprintf("Fatal error: %v", err))
+		}
+	}()
+
+	var err error
+	a.torrentInfo, err = a.loadTorrent(input)
+	if err != nil {
+		a.setStatus(err.Error())
 		return
 	}
 
-	peers, err := client.ExtractPeers(rawResponse)
+	peerId := pkg.GeneratePeerId()
+
+	peers, announced, err := a.findPeers(peerId)
 	if err != nil {
-		a.setStatus("Error extracting peers: " + err.Error())
+		a.setStatus(err.Error())
 		return
 	}
 
 	log.Printf("Got %d peers\n", len(peers))
 
-	for _, p := range peers {
-		go func(peer network.Peer) {
-			conn := network.NewPeerConnection(p, *a.torrentInfo, peerId, a.fileManager, a.pieceManager)
-			if err := conn.Start(); err != nil {
-				//	a.setStatus("Error starting peer connection: " + err.Error())
-			}
-		}(p)
+	if !a.torrentInfo.HasMetadata() {
+		a.setStatus("Fetching metadata from peers")
+
+		a.torrentInfo, err = a.fetchMetadata(peers, peerId)
+		if err != nil {
+			a.setStatus("Error fetching metadata: " + err.Error())
+			return
+		}
+	}
+
+	a.fileManager = storage.NewFileManager(*a.torrentInfo, saveDir)
+	a.pieceManager = storage.NewPieceManager(*a.torrentInfo)
+	a.pieceManager.SetStrategy(a.strategy)
+
+	a.ready = true
+
+	extensions := network.NewExtensionRegistry()
+	metadata := network.NewMetadataFromRaw(a.torrentInfo.InfoHash(), a.torrentInfo.InfoRaw())
+	if _, err := extensions.Register(network.UtMetadataName, network.NewUtMetadataExtension(metadata)); err != nil {
+		a.setStatus("Error registering extension: " + err.Error())
+		return
+	}
+
+	if _, err := extensions.Register(network.UtPexName, network.NewUtPexExtension()); err != nil {
+		a.setStatus("Error registering extension: " + err.Error())
+		return
+	}
+
+	if a.torrentInfo.Private() {
+		log.Println("Private torrent, only using its trackers")
+	}
+
+	swarm := network.NewSwarm(*a.torrentInfo, peerId, a.fileManager, a.pieceManager, extensions, a.port, a.connLimiter)
+	swarm.SnubTimeout = a.snubTimeout
+	a.Lock()
+	a.swarm = swarm
+	a.Unlock()
+
+	if a.listener != nil {
+		a.listener.Register(swarm.InfoHash(), swarm.HandleIncoming)
+	}
+
+	go network.NewChoker(swarm, a.uploadSlots).Run()
+	go swarm.RunPex()
+	go swarm.RunConnections()
+
+	if !a.trackers.Empty() {
+		pieceManager := a.pieceManager
+		announcer := network.NewAnnouncer(a.trackers, network.AnnounceParams{
+			InfoHash: a.torrentInfo.InfoHash(),
+			PeerId:   peerId,
+			Port:     a.port,
+			NumWant:  -1,
+		}, func() (int64, int64, int64) {
+			return int64(pieceManager.TotalUploaded()), int64(pieceManager.TotalDownloaded()), pieceManager.BytesLeft()
+		}, pieceManager.Done(), swarm.AddPeers)
+
+		a.Lock()
+		a.announcer = announcer
+		a.Unlock()
+
+		go announcer.Run(announced)
+	}
+
+	if a.dht != nil {
+		go a.announceDHT(swarm)
+	}
+
+	if a.lsd != nil {
+		swarm.RegisterLSD(a.lsd)
 	}
 
+	swarm.AddPeers(peers)
+
 	a.setStatus("Anoosha gom")
 	a.isDownloading = true
 }
 
+// startDHT resumes the DHT saved at statePath, or starts a fresh one when
+// there is nothing usable to resume
+func startDHT(port int, statePath string) (*network.DHT, error) {
+	if statePath != "" {
+		state, err := network.LoadDHTState(statePath)
+		if err == nil {
+			return network.NewDHTFromState(port, state)
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Ignoring DHT state: %v\n", err)
+		}
+	}
+
+	return network.NewDHT(port)
+}
+
+func defaultDHTStatePath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "dht.dat"
+	}
+
+	return filepath.Join(dir, "gotor", "dht.dat")
+}
+
+// splitList splits a comma separated flag value, dropping empty items
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// parseInfoHashes reads a comma separated list of hex info hashes
+func parseInfoHashes(list string) ([][20]byte, error) {
+	var hashes [][20]byte
+	for _, item := range splitList(list) {
+		raw, err := hex.DecodeString(item)
+		if err != nil || len(raw) != 20 {
+			return nil, fmt.Errorf("invalid info hash: %s", item)
+		}
+		hashes = append(hashes, [20]byte(raw))
+	}
+
+	return hashes, nil
+}
+
 func main() {
-	var filePathFlag = flag.String("i", "", "input torrent file path")
+	var filePathFlag = flag.String("i", "", "input torrent file path or magnet uri")
 	var saveDirFlag = flag.String("o", "", "output directory path")
+	var portFlag = flag.Int("p", 42069, "port to accept incoming peer connections on")
+	var slotsFlag = flag.Int("slots", network.DefaultUploadSlots, "number of peers to upload to at once, not counting the optimistic unchoke")
+	var maxConnsFlag = flag.Int("max-conns", network.DefaultConnLimits().MaxConns, "maximum number of peer connections over all torrents")
+	var maxPeersFlag = flag.Int("max-peers", network.DefaultConnLimits().MaxConnsPerTorrent, "maximum number of peer connections per torrent")
+	var maxHalfOpenFlag = flag.Int("max-half-open", network.DefaultConnLimits().MaxHalfOpen, "maximum number of peer connections being dialed at once")
+	var snubTimeoutFlag = flag.Duration("snub-timeout", network.DefaultSnubTimeout, "stop relying on peers that leave our requests unanswered for this long")
+	var strategyFlag = flag.String("strategy", "rarest", "piece selection strategy: rarest or sequential")
+	var announceAllFlag = flag.Bool("announce-all", false, "announce to every tracker tier at once instead of falling back tier by tier")
+	var trackerTimeoutFlag = flag.Duration("tracker-timeout", network.DefaultTrackerClientConfig().Timeout, "timeout for HTTP tracker requests")
+	var trackerInsecureFlag = flag.Bool("tracker-insecure", false, "skip TLS certificate verification for HTTPS trackers")
+	var udpRetransmitsFlag = flag.Int("tracker-udp-retransmits", network.DefaultUDPMaxRetransmits, "retransmits of a UDP tracker request before giving up, e.g. 2 moves on after 15+30+60s")
+	var dhtFlag = flag.Bool("dht", true, "find peers through the mainline DHT")
+	var dhtStateFlag = flag.String("dht-state", defaultDHTStatePath(), "file the DHT routing table is kept in between runs")
+	var dhtBootstrapFlag = flag.String("dht-bootstrap", strings.Join(network.DefaultBootstrapNodes, ","), "comma separated host:port DHT nodes to bootstrap from")
+	var lsdFlag = flag.Bool("lsd", true, "find peers on the local network through multicast announces")
+	var serveTrackerFlag = flag.String("serve-tracker", "", "host a tracker over HTTP on this address, e.g. :6969")
+	var serveTrackerUDPFlag = flag.String("serve-tracker-udp", "", "also host the tracker over UDP on this address")
+	var trackerWhitelistFlag = flag.String("tracker-whitelist", "", "comma separated hex info hashes the hosted tracker accepts, empty accepts any")
 	flag.Parse()
 
+	var trackerServer *tracker.Server
+	if *serveTrackerFlag != "" {
+		whitelist, err := parseInfoHashes(*trackerWhitelistFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		config := tracker.DefaultConfig()
+		config.HTTPAddr = *serveTrackerFlag
+		config.UDPAddr = *serveTrackerUDPFlag
+		config.Whitelist = whitelist
+
+		trackerServer = tracker.NewServer(config)
+		go func() {
+			if err := trackerServer.ListenAndServe(); err != nil {
+				log.Fatalf("Tracker: %v\n", err)
+			}
+		}()
+		defer trackerServer.Close()
+	}
+
+	// only hosting a tracker
+	if trackerServer != nil && *filePathFlag == "" {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+		<-sigChan
+		return
+	}
+
 	if *filePathFlag == "" || *saveDirFlag == "" {
-		log.Fatal("Usage: ./main.exe -i input.torrent -o ./output_dir")
+		log.Fatal("Usage: ./main.exe -i input.torrent|magnet-uri -o ./output_dir")
 	}
 
-	app := &App{}
+	strategy, err := storage.ParsePickStrategy(*strategyFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	trackerConfig := network.DefaultTrackerClientConfig()
+	trackerConfig.Timeout = *trackerTimeoutFlag
+	trackerConfig.InsecureSkipVerify = *trackerInsecureFlag
+
+	limits := network.DefaultConnLimits()
+	limits.MaxConns = *maxConnsFlag
+	limits.MaxConnsPerTorrent = min(*maxPeersFlag, *maxConnsFlag)
+	limits.MaxHalfOpen = *maxHalfOpenFlag
+	limits.MaxHalfOpenPerTorrent = min(limits.MaxHalfOpenPerTorrent, *maxHalfOpenFlag)
+
+	app := &App{port: *portFlag, uploadSlots: *slotsFlag, strategy: strategy, announceAll: *announceAllFlag, trackerConfig: trackerConfig, udpRetransmits: *udpRetransmitsFlag, connLimiter: network.NewConnLimiter(limits), snubTimeout: *snubTimeoutFlag}
+
+	listener, err := network.Listen(*portFlag)
+	if err != nil {
+		log.Printf("Not accepting incoming peers: %v\n", err)
+	} else {
+		app.listener = listener
+		app.port = listener.Port()
+		go func() {
+			if err := listener.Serve(); err != nil {
+				log.Printf("Listener stopped: %v\n", err)
+			}
+		}()
+	}
+
+	if *dhtFlag {
+		dht, err := startDHT(app.port, *dhtStateFlag)
+		if err != nil {
+			log.Printf("DHT disabled: %v\n", err)
+		} else {
+			app.dht = dht
+			app.dhtStatePath = *dhtStateFlag
+			go func() {
+				if err := dht.Serve(); err != nil {
+					log.Printf("DHT stopped: %v\n", err)
+				}
+			}()
+			go func() {
+				if err := dht.Bootstrap(splitList(*dhtBootstrapFlag)); err != nil {
+					log.Printf("DHT bootstrap failed: %v\n", err)
+				}
+			}()
+		}
+	}
+
+	if *lsdFlag {
+		lsd, err := network.NewLSD(app.port)
+		if err != nil {
+			log.Printf("LSD disabled: %v\n", err)
+		} else {
+			app.lsd = lsd
+			go func() {
+				if err := lsd.Serve(); err != nil {
+					log.Printf("LSD stopped: %v\n", err)
+				}
+			}()
+		}
+	}
 
 	go app.startDownload(*filePathFlag, *saveDirFlag)
 	go func() {
@@ -166,6 +523,10 @@ func main() {
 			imgui.Text(fmt.Sprintf("Downloaded: %d MB / %.2f MB", app.pieceManager.TotalDownloadedMB(), float64(app.torrentInfo.TotalLength())/1024/1024))
 			imgui.Text(fmt.Sprintf("Progress: %.2f%%", app.pieceManager.Progress()*100))
 			imgui.Text(fmt.Sprintf("Speed: %.2f MB/s", app.pieceManager.GetSpeed()))
+			if app.swarm != nil {
+				stats := app.swarm.ConnStats()
+				imgui.Text(fmt.Sprintf("Peers: %d connected, %d connecting, %d known", stats.Connected, stats.HalfOpen, stats.Known))
+			}
 			app.Unlock()
 
 			imgui.ProgressBarV(app.pieceManager.Progress(), imgui.Vec2{X: -1, Y: 0}, "")
@@ -3,17 +3,9 @@ package pkg
 import (
 	"fmt"
 	"math/rand"
-	"net/url"
-	"strconv"
 	"strings"
 )
 
-type ParsedUrl struct {
-	Host string
-	Path string
-	Port int
-}
-
 func GeneratePeerId() string {
 	const prefix = "-F4T001-"
 	const charset = "0123456789"
@@ -40,20 +32,3 @@ func UrlEncode(value string) string {
 
 	return buf.String()
 }
-
-func ParseTrackerUrl(trackerUrl string) (ParsedUrl, error) {
-	url, err := url.Parse(trackerUrl)
-	if err != nil {
-		return ParsedUrl{}, err
-	}
-
-	host := url.Hostname()
-	portStr := url.Port()
-
-	port := 80
-	if portStr != "" {
-		port, _ = strconv.Atoi(portStr)
-	}
-
-	return ParsedUrl{Host: host, Path: url.Path, Port: port}, nil
-}